@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const systemProfile = "/nix/var/nix/profiles/system"
+
+// Matches the generation links nix keeps next to a profile,
+// e.g. system-42-link.
+var generationLink = regexp.MustCompile(`-(\d+)-link$`)
+
+// homeProfile returns the Home Manager profile of the current user, which
+// lives in the XDG state directory on current versions and under per-user
+// profiles on older ones.
+func homeProfile() string {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, _ := os.UserHomeDir()
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+
+	profile := filepath.Join(stateHome, "nix", "profiles", "home-manager")
+	if _, err := os.Lstat(profile); err == nil {
+		return profile
+	}
+
+	if current, err := user.Current(); err == nil {
+		return filepath.Join("/nix/var/nix/profiles/per-user", current.Username, "home-manager")
+	}
+	return profile
+}
+
+// profileGeneration returns the generation profile currently points to, or
+// zero if it does not exist.
+func profileGeneration(profile string) int {
+	link, err := os.Readlink(profile)
+	if err != nil {
+		return 0
+	}
+
+	return linkGeneration(link)
+}
+
+func linkGeneration(link string) int {
+	match := generationLink.FindStringSubmatch(link)
+	if match == nil {
+		return 0
+	}
+
+	generation, _ := strconv.Atoi(match[1])
+	return generation
+}
+
+func systemInstallable(flakeRef, hostName string) string {
+	return flakeRef + "#nixosConfigurations." + strconv.Quote(hostName) + ".config.system.build.toplevel"
+}
+
+func homeInstallable(flakeRef, profile string) string {
+	return flakeRef + "#homeConfigurations." + strconv.Quote(profile) + ".activationPackage"
+}
+
+// Characters NixOS allows in system.nixos.label.
+var labelUnsafe = regexp.MustCompile(`[^a-zA-Z0-9:_.-]+`)
+
+// generationLabel names a system generation after the flake checkout it is
+// built from, e.g. main-1a2b3c4-dirty, or returns "" outside of git.
+func generationLabel() string {
+	if report.FlakeCommit == "" {
+		return ""
+	}
+
+	var parts []string
+	if report.FlakeBranch != "" {
+		parts = append(parts, labelUnsafe.ReplaceAllString(report.FlakeBranch, "_"))
+	}
+	parts = append(parts, report.FlakeCommit[:min(7, len(report.FlakeCommit))])
+	if report.FlakeDirty {
+		parts = append(parts, "dirty")
+	}
+	return strings.Join(parts, "-")
+}
+
+// Temporary out-links of the builds of this run, which keep their results
+// from garbage collection until the run ends, as nixos-rebuild does.
+var (
+	buildLinksDir string
+	buildLinksMu  sync.Mutex
+	buildLinks    int
+)
+
+// tempOutLink returns a new out-link in the temporary directory of the run.
+func tempOutLink() (string, error) {
+	buildLinksMu.Lock()
+	defer buildLinksMu.Unlock()
+
+	if buildLinksDir == "" {
+		dir, err := os.MkdirTemp("", "no-build-")
+		if err != nil {
+			return "", err
+		}
+		buildLinksDir = dir
+	}
+
+	buildLinks++
+	return filepath.Join(buildLinksDir, "result-"+strconv.Itoa(buildLinks)), nil
+}
+
+// removeTempOutLinks drops the temporary out-links once the run is over,
+// leaving their results to the profiles and roots that now refer to them.
+func removeTempOutLinks() {
+	buildLinksMu.Lock()
+	defer buildLinksMu.Unlock()
+
+	if buildLinksDir != "" {
+		os.RemoveAll(buildLinksDir)
+		buildLinksDir = ""
+	}
+}
+
+// nixBuild builds installable and returns its store path. The build runs on
+// buildHost over ssh when it is set and on this machine otherwise. The result
+// is linked at outLink, or at a temporary out-link until the run ends when
+// outLink is empty. Results on a build host are not linked. A label is
+// handed to NixOS as NIXOS_LABEL, which needs an impure evaluation.
+func nixBuild(ctx context.Context, installable, buildHost, outLink, label string) (string, error) {
+	if outLink == "" && buildHost == "" {
+		var err error
+		if outLink, err = tempOutLink(); err != nil {
+			return "", err
+		}
+	}
+
+	args := []string{"build", "--print-out-paths", installable}
+	if label != "" {
+		args = append(args, "--impure")
+	}
+	if buildHost != "" {
+		args = append(args, "--eval-store", "auto", "--store", "ssh-ng://"+buildHost)
+	}
+	if outLink == "" {
+		args = append(args, "--no-link")
+	} else {
+		args = append(args, "--out-link", outLink)
+	}
+	args = append(args, nixLogArgs()...)
+
+	var out bytes.Buffer
+
+	cmd := command(ctx, "nix", args...)
+	if label != "" {
+		setEnv(cmd, "NIXOS_LABEL="+label)
+	}
+
+	progress, finishProgress := newProgress()
+
+	cmd.Stdout = &out
+	cmd.Stderr = progress
+
+	err := cmd.Run()
+	finishProgress()
+	if err != nil {
+		return "", fmt.Errorf("nix build: %w", err)
+	}
+
+	path := strings.TrimSpace(out.String())
+	report.StorePaths = append(report.StorePaths, path)
+
+	return path, nil
+}
+
+// transientUnit wraps argv to run in a transient systemd service named unit,
+// as nixos-rebuild does, so that an activation finishes even when no is
+// killed or loses its terminal or ssh connection.
+func transientUnit(unit string, argv []string) []string {
+	return append([]string{
+		"systemd-run",
+		"--quiet",
+		"--collect",
+		"--wait",
+		"--pipe",
+		"--no-ask-password",
+		"--service-type=exec",
+		"--unit=" + unit,
+	}, argv...)
+}
+
+// activateSystem does what nixos-rebuild does after building: point the
+// system profile of target at path for switch and boot, then run its
+// activation script in a transient unit, under the watchdog of rollback if
+// there is one, which is confirmed as soon as the script is done. It returns
+// the units the activation changed.
+//
+// Timeouts and signals only stop no from waiting: the script goes on in its
+// unit, as stopping it halfway through a switch is worse than letting it
+// finish. An unconfirmed rollback then fires once the script is done.
+func activateSystem(ctx context.Context, target Target, path, operation string, rollback *MagicRollback) (UnitChanges, error) {
+	if operation == "switch" || operation == "boot" {
+		profileCmd := target.EscalatedCommand(ctx,
+			"nix-env",
+			"--profile",
+			systemProfile,
+			"--set",
+			path)
+
+		profileCmd.Stdout, profileCmd.Stderr = target.outputs()
+
+		if err := profileCmd.Run(); err != nil {
+			return UnitChanges{}, fmt.Errorf("nix-env --set: %w", err)
+		}
+	}
+
+	argv := []string{path + "/bin/switch-to-configuration", operation}
+	unit := "no-activate-" + strconv.FormatInt(time.Now().Unix(), 10)
+	if rollback != nil {
+		unit = rollback.activationUnit()
+		argv = rollback.wrap(argv)
+	} else {
+		argv = transientUnit(unit, argv)
+	}
+
+	activateCmd := target.EscalatedCommand(ctx, argv[0], argv[1:]...)
+
+	var output Capture
+	out, errOut := target.outputs()
+
+	activateCmd.Stdout = io.MultiWriter(out, &output)
+	activateCmd.Stderr = io.MultiWriter(errOut, &output)
+
+	err := activateCmd.Run()
+	if ctx.Err() != nil {
+		logger.Warn("stopped waiting for the activation, it goes on in its transient unit", "host", target.Host, "unit", unit)
+		return parseUnitChanges(output.String()), context.Cause(ctx)
+	}
+
+	// Confirm right away: the rollback timer is already running, and fetching
+	// journals of a host that became unreachable would only eat into it.
+	var confirmErr error
+	if rollback != nil {
+		confirmErr = rollback.Confirm(ctx)
+	}
+
+	changes := parseUnitChanges(output.String())
+	if confirmErr == nil {
+		changes.fetchJournals(ctx, target)
+	}
+	changes.Print(out)
+
+	if confirmErr != nil {
+		return changes, confirmErr
+	}
+	if err != nil && len(changes.Failed) > 0 {
+		var units []string
+		for _, failed := range changes.Failed {
+			units = append(units, failed.Unit)
+		}
+		return changes, &FailedUnitsError{Units: units, Err: err}
+	}
+	if err != nil {
+		return changes, fmt.Errorf("switch-to-configuration: %w", err)
+	}
+
+	return changes, nil
+}
+
+func activateHome(ctx context.Context, path string) error {
+	activateCmd := command(ctx, path+"/activate")
+
+	activateCmd.Stdout = stdout
+	activateCmd.Stderr = stderr
+
+	if err := activateCmd.Run(); err != nil {
+		return fmt.Errorf("home-manager activate: %w", err)
+	}
+
+	return nil
+}
+
+// RebuildOptions says where a system is built and activated, and what
+// happens after activation.
+type RebuildOptions struct {
+	Target    Target
+	BuildHost string
+	// Check runs the health checks after switch and test, and Rollback
+	// returns to the previous generation when they fail.
+	Check    bool
+	Rollback bool
+	// RebootIfNeeded reboots the target when the activated system changed
+	// its kernel, initrd, kernel modules or systemd.
+	RebootIfNeeded bool
+	// Label names the generation after the flake checkout, see
+	// generationLabel.
+	Label bool
+	// FlakeRef is the flake to build from, the one in the current directory
+	// when empty.
+	FlakeRef string
+}
+
+// rebuildSystem builds the configuration hostName of the flake and
+// activates it on the target, each in its own phase. The build runs on the
+// build host when there is one, and the result is copied to the target when
+// that is another machine.
+func rebuildSystem(ctx context.Context, hostName, operation string, opts RebuildOptions) error {
+	var path string
+
+	if opts.FlakeRef == "" {
+		opts.FlakeRef = "."
+	}
+
+	target, buildHost := opts.Target, opts.BuildHost
+
+	report.Target = hostName
+	report.TargetHost = target.Host
+	report.BuildHost = buildHost
+	report.Operation = operation
+
+	var label string
+	if opts.Label {
+		label = generationLabel()
+	}
+
+	switch operation {
+	case "build-vm", "build-vm-with-bootloader":
+		if !target.Local() || buildHost != "" {
+			return fmt.Errorf("%s can only be run on this machine", operation)
+		}
+
+		return runPhase(ctx, phaseBuild, func(ctx context.Context) error {
+			cmd := command(ctx,
+				"nixos-rebuild",
+				operation,
+				"--flake",
+				opts.FlakeRef+"#"+hostName)
+
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("nixos-rebuild: %w", err)
+			}
+			return nil
+		})
+	case "build":
+		return runPhase(ctx, phaseBuild, func(ctx context.Context) error {
+			outLink := "result"
+			if buildHost != "" {
+				outLink = ""
+			}
+
+			path, err := nixBuild(ctx, systemInstallable(opts.FlakeRef, hostName), buildHost, outLink, label)
+			if err == nil && buildHost != "" {
+				logger.Info("Built " + path + " on " + buildHost)
+			} else if err == nil {
+				logger.Info("Built " + path)
+			}
+			return err
+		})
+	}
+
+	err := runPhase(ctx, phaseBuild, func(ctx context.Context) (err error) {
+		path, err = nixBuild(ctx, systemInstallable(opts.FlakeRef, hostName), buildHost, "", label)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return switchSystem(ctx, hostName, path, operation, opts)
+}
+
+// switchSystem brings the system path, built here or on the build host, to
+// the target and activates it there, then runs the health checks and looks
+// for changes that need a reboot.
+func switchSystem(ctx context.Context, hostName, path, operation string, opts RebuildOptions) error {
+	target, buildHost := opts.Target, opts.BuildHost
+
+	if !target.Local() || buildHost != "" {
+		logger.Info("Copying " + path + " to " + target.String() + "...")
+
+		err := runPhase(ctx, phaseCopy, func(ctx context.Context) error {
+			return copyClosure(ctx, target, path, buildHost)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	report.GenerationBefore = target.Generation(ctx, systemProfile)
+
+	check := opts.Check && (operation == "switch" || operation == "test")
+
+	var previous string
+	if check && opts.Rollback {
+		var err error
+		if previous, err = previousSystem(ctx, target, operation); err != nil {
+			return err
+		}
+	}
+
+	err := runPhase(ctx, phaseActivation, func(ctx context.Context) error {
+		rollback, err := prepareRollback(ctx, target, operation)
+		if err != nil {
+			return err
+		}
+
+		changes, err := activateSystem(ctx, target, path, operation, rollback)
+		if !changes.Empty() {
+			report.Units = &changes
+		}
+		return err
+	})
+
+	report.GenerationAfter = target.Generation(ctx, systemProfile)
+
+	// Units that failed to start are left to the health checks, which roll
+	// them back like any other failure.
+	var unitsErr *FailedUnitsError
+	if err != nil && (!check || !errors.As(err, &unitsErr)) {
+		return err
+	}
+
+	if target.Local() && report.GenerationAfter != report.GenerationBefore {
+		recordGeneration(ctx, systemProfile, report.GenerationAfter)
+	}
+
+	if check {
+		err = checkSystem(ctx, hostName, target, previous, operation, opts.Rollback, unitsErr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if operation == "dry-activate" {
+		return nil
+	}
+	return checkReboot(ctx, target, path, operation, opts.RebootIfNeeded)
+}
+
+// checkSystem runs the health checks of hostName on target in their own
+// phase, rolling back to previous when they or the units of the activation
+// failed and rollback is set.
+func checkSystem(ctx context.Context, hostName string, target Target, previous, operation string, rollback bool, unitsErr *FailedUnitsError) error {
+	return runPhase(ctx, phaseCheck, func(ctx context.Context) error {
+		results, err := runHealthChecks(ctx, target, healthChecks(hostName))
+		results, err = withFailedUnits(target, results, err, unitsErr)
+		report.HealthChecks = results
+
+		var healthErr *HealthError
+		if !errors.As(err, &healthErr) || !rollback {
+			return err
+		}
+
+		logger.Warnf("Rolling back %s to generation %d...", target, report.GenerationBefore)
+
+		if rollbackErr := rollbackSystem(ctx, target, previous, report.GenerationBefore, operation); rollbackErr != nil {
+			return fmt.Errorf("%w; %w", err, rollbackErr)
+		}
+
+		report.GenerationAfter = target.Generation(ctx, systemProfile)
+		healthErr.RolledBack = true
+		return healthErr
+	})
+}
+
+// rebuildHome builds the Home Manager configuration profile of flakeRef and
+// activates it, each in its own phase.
+func rebuildHome(ctx context.Context, profile, operation, flakeRef string) error {
+	report.Target = profile
+	report.Operation = operation
+
+	switch operation {
+	case "instantiate":
+		return runPhase(ctx, phaseBuild, func(ctx context.Context) error {
+			cmd := command(ctx,
+				"nix",
+				"eval",
+				"--raw",
+				homeInstallable(flakeRef, profile)+".drvPath")
+
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("nix eval: %w", err)
+			}
+			return nil
+		})
+	case "build":
+		return runPhase(ctx, phaseBuild, func(ctx context.Context) error {
+			path, err := nixBuild(ctx, homeInstallable(flakeRef, profile), "", "result", "")
+			if err == nil {
+				logger.Info("Built " + path)
+			}
+			return err
+		})
+	}
+
+	var path string
+	err := runPhase(ctx, phaseBuild, func(ctx context.Context) (err error) {
+		path, err = nixBuild(ctx, homeInstallable(flakeRef, profile), "", "", "")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	profilePath := homeProfile()
+	report.GenerationBefore = profileGeneration(profilePath)
+
+	err = runPhase(ctx, phaseActivation, func(ctx context.Context) error {
+		return activateHome(ctx, path)
+	})
+
+	report.GenerationAfter = profileGeneration(profilePath)
+	if err == nil && report.GenerationAfter != report.GenerationBefore {
+		recordGeneration(ctx, profilePath, report.GenerationAfter)
+	}
+	return err
+}
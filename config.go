@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type Config struct {
+	Escalation       string              `json:"escalation"`
+	RemoteEscalation string              `json:"remote_escalation"`
+	Timeouts         map[string]Duration `json:"timeouts"`
+	LogRetention     int                 `json:"log_retention"`
+	LogLevel         string              `json:"log_level"`
+	LogFormat        string              `json:"log_format"`
+	LogTimestamps    bool                `json:"log_timestamps"`
+	Color            string              `json:"color"`
+	Hosts            map[string]Host     `json:"hosts"`
+	ConfirmTimeout   *Duration           `json:"confirm_timeout"`
+	HealthChecks     []HealthCheck       `json:"health_checks"`
+}
+
+var config Config
+
+func configPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "no", "config.json"), nil
+}
+
+func loadConfig() error {
+	path, err := configPath()
+	if err != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return nil
+}
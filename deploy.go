@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Host is an entry of the inventory: a NixOS configuration of the flake and
+// the machine it is deployed to.
+type Host struct {
+	Target       string        `json:"target"`
+	BuildHost    string        `json:"build_host"`
+	Escalation   string        `json:"escalation"`
+	Tags         []string      `json:"tags"`
+	HealthChecks []HealthCheck `json:"health_checks"`
+}
+
+// HostReport is the outcome of a deployment on one host: ok, failed,
+// unhealthy, skipped or rolled-back.
+type HostReport struct {
+	Name             string        `json:"name"`
+	TargetHost       string        `json:"target_host"`
+	Batch            int           `json:"batch,omitempty"`
+	StorePath        string        `json:"store_path,omitempty"`
+	GenerationBefore int           `json:"generation_before,omitempty"`
+	GenerationAfter  int           `json:"generation_after,omitempty"`
+	Status           string        `json:"status"`
+	Error            string        `json:"error,omitempty"`
+	Units            *UnitChanges  `json:"units,omitempty"`
+	HealthChecks     []CheckResult `json:"health_checks,omitempty"`
+}
+
+const (
+	defaultDeployJobs = 4
+	defaultCanary     = "10%"
+	defaultBatchSize  = "25%"
+	defaultBatchPause = 30 * time.Second
+)
+
+// inventory returns the hosts of the config, or when there are none, every
+// NixOS configuration of the flake deployed over ssh to the host of the same
+// name. Hosts of the config without a target are reached by their name too,
+// so that a deployment never ends up activating on this machine.
+func inventory(ctx context.Context) (map[string]Host, error) {
+	if len(config.Hosts) > 0 {
+		hosts := map[string]Host{}
+		for name, host := range config.Hosts {
+			if host.Target == "" {
+				host.Target = name
+			}
+			hosts[name] = host
+		}
+		return hosts, nil
+	}
+
+	var out bytes.Buffer
+
+	cmd := command(ctx,
+		"nix",
+		"eval",
+		"--json",
+		".#nixosConfigurations",
+		"--apply",
+		"builtins.attrNames")
+
+	cmd.Stdout = &out
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("nix eval: %w", err)
+	}
+
+	var names []string
+	if err := json.Unmarshal(out.Bytes(), &names); err != nil {
+		return nil, fmt.Errorf("nix eval: %w", err)
+	}
+
+	hosts := map[string]Host{}
+	for _, name := range names {
+		hosts[name] = Host{Target: name}
+	}
+	return hosts, nil
+}
+
+// selectHosts picks the hosts named, or all of them, keeping those with tag.
+func selectHosts(hosts map[string]Host, names []string, tag string) ([]string, error) {
+	if len(names) == 0 {
+		for name := range hosts {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var selected []string
+	for _, name := range names {
+		host, ok := hosts[name]
+		if !ok {
+			return nil, fmt.Errorf("no host named %q in the inventory", name)
+		}
+		if tag == "" || slices.Contains(host.Tags, tag) {
+			selected = append(selected, name)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no hosts selected")
+	}
+	return selected, nil
+}
+
+// prefixWriter writes whole lines to w, each starting with prefix, so that
+// the output of hosts deployed in parallel stays readable.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+// Write may be called from several goroutines at once, e.g. by the two
+// copies of an exec.Cmd writing stdout and stderr, so all of it holds mu.
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, data...)
+
+	for {
+		idx := bytes.IndexByte(p.buf, '\n')
+		if idx < 0 {
+			break
+		}
+
+		_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf[:idx])
+		if err != nil {
+			return 0, err
+		}
+
+		p.buf = p.buf[idx+1:]
+	}
+
+	return len(data), nil
+}
+
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.Write([]byte{'\n'})
+	}
+}
+
+// parallel runs fn for every index in 0..n, at most jobs at a time.
+func parallel(n, jobs int, fn func(i int)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// batchSize reads a batch size given as a number of hosts or a percentage of
+// total, rounded up so that every batch has at least one host.
+func batchSize(spec string, total int) (int, error) {
+	if percent, ok := strings.CutSuffix(spec, "%"); ok {
+		p, err := strconv.Atoi(percent)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid batch size %q", spec)
+		}
+		return max(1, (total*p+99)/100), nil
+	}
+
+	n, err := strconv.Atoi(spec)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid batch size %q", spec)
+	}
+	return n, nil
+}
+
+// canaryBatches splits the selected hosts into batches: first the canary,
+// given as a comma separated list of hosts or a size, then the others in
+// batches of batch. Host names win over sizes, so a host named 2 can be the
+// canary.
+func canaryBatches(names []string, canary, batch string) ([][]int, error) {
+	var first []int
+
+	unknown := ""
+	hosts := true
+	for _, name := range strings.Split(canary, ",") {
+		name = strings.TrimSpace(name)
+		idx := slices.Index(names, name)
+		if idx < 0 {
+			unknown, hosts = name, false
+			break
+		}
+		if !slices.Contains(first, idx) {
+			first = append(first, idx)
+		}
+	}
+
+	if !hosts {
+		size, err := batchSize(canary, len(names))
+		if err != nil {
+			return nil, fmt.Errorf("canary %q is neither a size nor one of the selected hosts", unknown)
+		}
+
+		first = nil
+		for i := 0; i < min(size, len(names)); i++ {
+			first = append(first, i)
+		}
+	}
+
+	var rest []int
+	for i := range names {
+		if !slices.Contains(first, i) {
+			rest = append(rest, i)
+		}
+	}
+
+	size, err := batchSize(batch, len(names))
+	if err != nil {
+		return nil, err
+	}
+
+	batches := [][]int{first}
+	for len(rest) > 0 {
+		n := min(size, len(rest))
+		batches = append(batches, rest[:n])
+		rest = rest[n:]
+	}
+	return batches, nil
+}
+
+// deployment is the state of one no deploy run, indexed like names.
+type deployment struct {
+	operation string
+	jobs      int
+	names     []string
+	hosts     map[string]Host
+	targets   []Target
+	results   []HostReport
+	previous  []string
+	activated []bool
+	unitsErrs []*FailedUnitsError
+}
+
+func (d *deployment) build(ctx context.Context) error {
+	logger.Infof("Building %d hosts...", len(d.names))
+
+	return runPhase(ctx, phaseBuild, func(ctx context.Context) error {
+		for i, name := range d.names {
+			if d.results[i].Error != "" {
+				continue
+			}
+
+			path, err := nixBuild(ctx, systemInstallable(".", name), d.hosts[name].BuildHost, "", "")
+			if err != nil {
+				d.results[i].Error = err.Error()
+				continue
+			}
+			d.results[i].StorePath = path
+		}
+		return context.Cause(ctx)
+	})
+}
+
+// activate copies to and activates the hosts of batch that built.
+func (d *deployment) activate(ctx context.Context, batch []int) error {
+	logger.Infof("Copying to %d hosts...", len(batch))
+
+	err := runPhase(ctx, phaseCopy, func(ctx context.Context) error {
+		parallel(len(batch), d.jobs, func(j int) {
+			i := batch[j]
+			if d.results[i].Error != "" {
+				return
+			}
+
+			err := copyClosure(ctx, d.targets[i], d.results[i].StorePath, d.hosts[d.names[i]].BuildHost)
+			if err != nil {
+				d.results[i].Error = err.Error()
+			}
+		})
+		return context.Cause(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Activating %d hosts...", len(batch))
+
+	return runPhase(ctx, phaseActivation, func(ctx context.Context) error {
+		parallel(len(batch), d.jobs, func(j int) {
+			i := batch[j]
+			if d.results[i].Error != "" {
+				return
+			}
+			d.activateHost(ctx, i)
+		})
+		return context.Cause(ctx)
+	})
+}
+
+func (d *deployment) activateHost(ctx context.Context, i int) {
+	target := d.targets[i]
+	result := &d.results[i]
+
+	result.GenerationBefore = target.Generation(ctx, systemProfile)
+
+	previous, err := previousSystem(ctx, target, d.operation)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	d.previous[i] = previous
+
+	rollback, err := prepareRollback(ctx, target, d.operation)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	d.activated[i] = true
+	changes, err := activateSystem(ctx, target, result.StorePath, d.operation, rollback)
+	if !changes.Empty() {
+		result.Units = &changes
+	}
+
+	result.GenerationAfter = target.Generation(ctx, systemProfile)
+
+	var rollbackErr *RollbackError
+	if errors.As(err, &rollbackErr) && rollbackErr.Fired {
+		result.Status = "rolled-back"
+		d.activated[i] = false
+	}
+
+	// Units that failed to start are left to the health checks, which roll
+	// them back like any other failure.
+	var unitsErr *FailedUnitsError
+	if errors.As(err, &unitsErr) && (d.operation == "switch" || d.operation == "test") {
+		d.unitsErrs[i] = unitsErr
+		err = nil
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	result.Status = "ok"
+}
+
+// checkHealth runs the health checks of the hosts of batch that activated,
+// returning whether all of them are healthy. Only switch and test change the
+// running system, so only they are checked.
+func (d *deployment) checkHealth(ctx context.Context, batch []int) bool {
+	if d.operation == "switch" || d.operation == "test" {
+		logger.Infof("Checking health of %d hosts...", len(batch))
+	}
+
+	parallel(len(batch), d.jobs, func(j int) {
+		i := batch[j]
+		if d.results[i].Status != "ok" || (d.operation != "switch" && d.operation != "test") {
+			return
+		}
+
+		checks, err := runHealthChecks(ctx, d.targets[i], healthChecks(d.names[i]))
+		checks, err = withFailedUnits(d.targets[i], checks, err, d.unitsErrs[i])
+		d.results[i].HealthChecks = checks
+		if err != nil {
+			d.results[i].Status = "unhealthy"
+			d.results[i].Error = err.Error()
+		}
+	})
+
+	for _, i := range batch {
+		if d.results[i].Status != "ok" {
+			return false
+		}
+	}
+	return true
+}
+
+// rollback undoes the activation of the hosts activated so far, or only of
+// the unhealthy ones.
+func (d *deployment) rollback(ctx context.Context, unhealthyOnly bool) {
+	var activated []int
+	for i := range d.names {
+		if d.activated[i] && (!unhealthyOnly || d.results[i].Status == "unhealthy") {
+			activated = append(activated, i)
+		}
+	}
+
+	if len(activated) == 0 {
+		return
+	}
+
+	logger.Warnf("Rolling back %d hosts...", len(activated))
+
+	parallel(len(activated), d.jobs, func(j int) {
+		i := activated[j]
+		result := &d.results[i]
+
+		err := rollbackSystem(ctx, d.targets[i], d.previous[i], result.GenerationBefore, d.operation)
+		if err != nil {
+			result.Error = strings.TrimPrefix(result.Error+"; ", "; ") + err.Error()
+			return
+		}
+
+		result.Status = "rolled-back"
+		result.GenerationAfter = d.targets[i].Generation(ctx, systemProfile)
+	})
+}
+
+func deployCmd(ctx context.Context, args []string) error {
+	var (
+		operation = "switch"
+		tag       string
+		jobs      int
+		strategy  string
+		canary    string
+		batch     string
+		pause     time.Duration
+		rollback  bool
+	)
+
+	operations := []string{"boot", "dry-activate", "switch", "test"}
+
+	flagSet := flag.NewFlagSet("deploy", flag.ExitOnError)
+	flagSet.StringVar(&tag, "tag", "", "only deploy hosts with this tag")
+	flagSet.StringVar(&tag, "t", "", "only deploy hosts with this tag")
+	flagSet.IntVar(&jobs, "jobs", defaultDeployJobs, "hosts to activate at once")
+	flagSet.IntVar(&jobs, "j", defaultDeployJobs, "hosts to activate at once")
+	flagSet.DurationVar(&confirmTimeout, "confirm-timeout", confirmTimeout, "time to confirm hosts are reachable")
+	flagSet.StringVar(&operation, "operation", operation, "activation operation")
+	flagSet.StringVar(&operation, "o", operation, "activation operation")
+	flagSet.StringVar(&strategy, "strategy", "all", "rollout strategy")
+	flagSet.StringVar(&strategy, "s", "all", "rollout strategy")
+	flagSet.StringVar(&canary, "canary", defaultCanary, "first batch")
+	flagSet.StringVar(&batch, "batch", defaultBatchSize, "size of following batches")
+	flagSet.DurationVar(&pause, "pause", defaultBatchPause, "time between batches")
+	flagSet.BoolVar(&rollback, "rollback", false, "roll back when health checks fail")
+	flagSet.Usage = func() {
+		logger.Print(`Deploy NixOS configurations to several machines.
+
+Usage:
+
+    no deploy [flags] [hosts...]
+
+Hosts come from the 'hosts' inventory in the config. Without one, every
+nixosConfigurations entry of the flake is deployed over ssh to the machine
+of the same name. All selected hosts are built first, then copied and
+activated in parallel. Escalation on the hosts cannot prompt for a password,
+so the ssh user must be root or allowed to escalate without one.
+
+After switch and test, every host runs its health checks from the config,
+or is checked for failed units when there are none.
+
+With the canary strategy, hosts are activated in batches instead: first the
+canary batch, then the others a batch at a time. The deployment continues
+after a pause only if all hosts of a batch are healthy. Otherwise it halts,
+leaving the remaining hosts untouched, and with --rollback reverts every
+host updated so far.
+
+Flags:
+
+    --batch  N|PERCENT
+        With the canary strategy, the size of the batches after the canary.
+        (default '25%')
+
+    --canary  N|PERCENT|HOSTS
+        With the canary strategy, the first batch: a number of hosts, a
+        percentage of them, or a comma separated list. (default '10%')
+
+    --confirm-timeout  DURATION
+        After switch or test, how long no has to reach each host again over
+        a fresh ssh connection before it rolls back to the previous
+        generation. 0 disables the rollback. (default '30s')
+
+    -j, --jobs  INT
+        Number of hosts to copy to and activate at once. (default '4')
+
+    -o, --operation  STRING
+        Activation operation: boot, dry-activate, switch or test.
+        (default 'switch')
+
+    --pause  DURATION
+        With the canary strategy, how long to wait after a healthy batch
+        before starting the next one. (default '30s')
+
+    --rollback  BOOL
+        Roll back hosts whose health checks fail. With the canary strategy,
+        roll back every host updated so far when a batch fails.
+
+    -s, --strategy  STRING
+        Rollout strategy: all at once, or canary. (default 'all')
+
+    -t, --tag  STRING
+        Only deploy hosts with this tag.
+
+    -h, --help
+        Print this help.
+
+Examples:
+
+    Deploy every host in the inventory
+        no deploy
+
+    Deploy the web servers, two at a time
+        no deploy -t web -j 2
+
+    Check what would change on two hosts
+        no deploy -o dry-activate web1 web2
+
+    Roll out to web1 first, then a third of the fleet at a time, undoing
+    everything if a host ends up with failed units
+        no deploy -s canary --canary web1 --batch 33% --rollback`)
+	}
+	flagSet.Parse(args)
+
+	if !slices.Contains(operations, operation) {
+		return fmt.Errorf("operation must be one of: %s", strings.Join(operations, ", "))
+	}
+	if strategy != "all" && strategy != "canary" {
+		return fmt.Errorf("strategy must be one of: all, canary")
+	}
+
+	err := os.Chdir(dir)
+	if err != nil {
+		return err
+	}
+
+	flake, err := flakeLock(true)
+	if err != nil {
+		return err
+	}
+
+	hosts, err := inventory(ctx)
+	if err != nil {
+		return err
+	}
+
+	names, err := selectHosts(hosts, flagSet.Args(), tag)
+	if err != nil {
+		return err
+	}
+
+	batches := [][]int{}
+	if strategy == "canary" {
+		batches, err = canaryBatches(names, canary, batch)
+		if err != nil {
+			return err
+		}
+	} else {
+		var all []int
+		for i := range names {
+			all = append(all, i)
+		}
+		batches = append(batches, all)
+	}
+
+	locks := []LockRequest{flake}
+	for _, name := range names {
+		locks = append(locks, hostLock(hosts[name].Target))
+	}
+
+	release, err := acquireLocks(ctx, locks...)
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	report.Target = strings.Join(names, ",")
+	report.Operation = operation
+
+	d := &deployment{
+		operation: operation,
+		jobs:      jobs,
+		names:     names,
+		hosts:     hosts,
+		targets:   make([]Target, len(names)),
+		results:   make([]HostReport, len(names)),
+		previous:  make([]string, len(names)),
+		activated: make([]bool, len(names)),
+		unitsErrs: make([]*FailedUnitsError, len(names)),
+	}
+
+	var outputMu sync.Mutex
+	var writers []*prefixWriter
+
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+
+	for i, name := range names {
+		host := hosts[name]
+
+		writer := &prefixWriter{
+			prefix: fmt.Sprintf("%-*s │ ", width, name),
+			w:      stdout,
+			mu:     &outputMu,
+		}
+		writers = append(writers, writer)
+
+		d.targets[i] = remoteTarget(host.Target, host.Escalation)
+		if d.targets[i].Local() {
+			return fmt.Errorf("host %s has no target", name)
+		}
+		d.targets[i].Log = writer
+		d.results[i] = HostReport{Name: name, TargetHost: host.Target, Status: "failed"}
+	}
+
+	for n, batch := range batches {
+		for _, i := range batch {
+			d.results[i].Batch = n + 1
+		}
+	}
+
+	// Hosts run in parallel without a terminal, so escalation on them must
+	// work without a password: as root or with NOPASSWD. It is checked on
+	// every host before anything is changed.
+	for i, target := range d.targets {
+		if err := target.Validate(ctx); err != nil {
+			d.results[i].Error = err.Error()
+		}
+	}
+
+	err = d.build(ctx)
+
+	for n, batch := range batches {
+		if err != nil {
+			break
+		}
+
+		if strategy == "canary" {
+			logger.Infof("Deploying batch %d of %d: %s", n+1, len(batches), strings.Join(d.batchNames(batch), ", "))
+		}
+
+		if err = d.activate(ctx, batch); err != nil {
+			break
+		}
+
+		// A failed canary batch halts the deployment, so everything activated
+		// so far is rolled back, otherwise only the unhealthy hosts.
+		var healthy bool
+		err = runPhase(ctx, phaseCheck, func(ctx context.Context) error {
+			healthy = d.checkHealth(ctx, batch)
+			if !healthy && rollback {
+				d.rollback(ctx, strategy != "canary")
+			}
+			return context.Cause(ctx)
+		})
+		if err != nil {
+			break
+		}
+
+		if strategy != "canary" {
+			continue
+		}
+
+		if !healthy {
+			for _, rest := range batches[n+1:] {
+				for _, i := range rest {
+					if d.results[i].Error == "" {
+						d.results[i].Status = "skipped"
+					}
+				}
+			}
+
+			logger.Errorf("Batch %d failed, halting the deployment", n+1)
+			break
+		}
+
+		if n < len(batches)-1 && pause > 0 {
+			logger.Infof("Batch %d is healthy, continuing in %s...", n+1, pause)
+
+			select {
+			case <-ctx.Done():
+				err = context.Cause(ctx)
+			case <-time.After(pause):
+			}
+		}
+	}
+
+	for _, writer := range writers {
+		writer.Flush()
+	}
+
+	report.Hosts = d.results
+	printHostResults(d.results, width)
+
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range d.results {
+		if result.Status != "ok" {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(d.results))
+	}
+	return nil
+}
+
+func (d *deployment) batchNames(batch []int) []string {
+	var names []string
+	for _, i := range batch {
+		names = append(names, d.names[i])
+	}
+	return names
+}
+
+func printHostResults(results []HostReport, width int) {
+	logger.Print("")
+	for _, result := range results {
+		generation := ""
+		if result.GenerationAfter > 0 {
+			generation = fmt.Sprintf("%d → %d", result.GenerationBefore, result.GenerationAfter)
+		}
+
+		mark := successStyle.Render("✓")
+		switch result.Status {
+		case "ok":
+		case "skipped":
+			mark = faintStyle.Render("-")
+		default:
+			mark = failureStyle.Render("✗")
+		}
+
+		logger.Printf("%s %-*s  %-24s %-12s %-10s %s", mark, width, result.Name, result.TargetHost, result.Status, generation, result.Error)
+	}
+}
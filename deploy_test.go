@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	config.Hosts = map[string]Host{
+		"web1": {Target: "root@web1.example.com", Tags: []string{"web"}},
+		"db":   {HealthChecks: []HealthCheck{{Type: "failed-units"}}},
+	}
+	defer func() { config.Hosts = nil }()
+
+	hosts, err := inventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"web1": "root@web1.example.com", "db": "db"} {
+		if got := hosts[name].Target; got != want {
+			t.Errorf("target of %s = %q, want %q", name, got, want)
+		}
+		if remoteTarget(hosts[name].Target, "").Local() {
+			t.Errorf("%s is deployed to this machine", name)
+		}
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		spec    string
+		total   int
+		want    int
+		wantErr bool
+	}{
+		{spec: "1", total: 10, want: 1},
+		{spec: "3", total: 10, want: 3},
+		{spec: "20", total: 10, want: 20},
+		{spec: "25%", total: 10, want: 3},
+		{spec: "33%", total: 10, want: 4},
+		{spec: "50%", total: 10, want: 5},
+		{spec: "100%", total: 7, want: 7},
+		{spec: "10%", total: 3, want: 1},
+		{spec: "1%", total: 250, want: 3},
+		{spec: "50%", total: 0, want: 1},
+		{spec: "0", total: 10, wantErr: true},
+		{spec: "-1", total: 10, wantErr: true},
+		{spec: "0%", total: 10, wantErr: true},
+		{spec: "101%", total: 10, wantErr: true},
+		{spec: "%", total: 10, wantErr: true},
+		{spec: "2.5%", total: 10, wantErr: true},
+		{spec: "half", total: 10, wantErr: true},
+		{spec: "", total: 10, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			got, err := batchSize(test.spec, test.total)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("batchSize(%q, %d) error = %v, want error %t", test.spec, test.total, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("batchSize(%q, %d) = %d, want %d", test.spec, test.total, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCanaryBatches(t *testing.T) {
+	fleet := []string{"web1", "web2", "web3", "db1", "db2"}
+
+	tests := []struct {
+		name    string
+		names   []string
+		canary  string
+		batch   string
+		want    [][]int
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			names:  fleet,
+			canary: "10%",
+			batch:  "25%",
+			want:   [][]int{{0}, {1, 2}, {3, 4}},
+		},
+		{
+			name:   "canary size",
+			names:  fleet,
+			canary: "2",
+			batch:  "2",
+			want:   [][]int{{0, 1}, {2, 3}, {4}},
+		},
+		{
+			name:   "canary larger than the fleet",
+			names:  fleet,
+			canary: "10",
+			batch:  "1",
+			want:   [][]int{{0, 1, 2, 3, 4}},
+		},
+		{
+			name:   "canary of all hosts",
+			names:  fleet,
+			canary: "100%",
+			batch:  "1",
+			want:   [][]int{{0, 1, 2, 3, 4}},
+		},
+		{
+			name:   "batch larger than the rest",
+			names:  fleet,
+			canary: "1",
+			batch:  "100%",
+			want:   [][]int{{0}, {1, 2, 3, 4}},
+		},
+		{
+			name:   "canary host",
+			names:  fleet,
+			canary: "db1",
+			batch:  "2",
+			want:   [][]int{{3}, {0, 1}, {2, 4}},
+		},
+		{
+			name:   "canary hosts in the given order",
+			names:  fleet,
+			canary: "db2,web1",
+			batch:  "50%",
+			want:   [][]int{{4, 0}, {1, 2, 3}},
+		},
+		{
+			name:   "canary hosts with spaces",
+			names:  fleet,
+			canary: "web2, db1",
+			batch:  "3",
+			want:   [][]int{{1, 3}, {0, 2, 4}},
+		},
+		{
+			name:   "canary host given twice",
+			names:  fleet,
+			canary: "web1,web1",
+			batch:  "2",
+			want:   [][]int{{0}, {1, 2}, {3, 4}},
+		},
+		{
+			name:   "numeric host name",
+			names:  []string{"1", "2", "3"},
+			canary: "2",
+			batch:  "1",
+			want:   [][]int{{1}, {0}, {2}},
+		},
+		{
+			name:   "numeric size with numeric host names",
+			names:  []string{"1", "2", "3"},
+			canary: "50%",
+			batch:  "1",
+			want:   [][]int{{0, 1}, {2}},
+		},
+		{
+			name:   "single host",
+			names:  []string{"web1"},
+			canary: "10%",
+			batch:  "25%",
+			want:   [][]int{{0}},
+		},
+		{
+			name:    "unknown canary host",
+			names:   fleet,
+			canary:  "web1,mail",
+			batch:   "2",
+			wantErr: true,
+		},
+		{
+			name:    "empty canary",
+			names:   fleet,
+			canary:  "",
+			batch:   "2",
+			wantErr: true,
+		},
+		{
+			name:    "invalid canary percentage",
+			names:   fleet,
+			canary:  "0%",
+			batch:   "2",
+			wantErr: true,
+		},
+		{
+			name:    "invalid batch",
+			names:   fleet,
+			canary:  "1",
+			batch:   "0",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := canaryBatches(test.names, test.canary, test.batch)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("canaryBatches(%q, %q) error = %v, want error %t", test.canary, test.batch, err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("canaryBatches(%q, %q) = %v, want %v", test.canary, test.batch, got, test.want)
+			}
+		})
+	}
+}
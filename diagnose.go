@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Output kept from a run for diagnostics.
+const diagnosticsLimit = 4 << 20
+
+type Diagnosis struct {
+	Category string `json:"category"`
+	Summary  string `json:"summary"`
+	Location string `json:"location,omitempty"`
+	Fix      string `json:"fix"`
+}
+
+type diagnostic struct {
+	category string
+	pattern  *regexp.Regexp
+	explain  func(match []string) (summary, fix string)
+}
+
+var diagnostics = []diagnostic{
+	{
+		category: "unfree",
+		pattern:  regexp.MustCompile(`Package ‘([^’]+)’ in \S+ has an unfree license \(‘([^’]+)’\), refusing to evaluate`),
+		explain: func(m []string) (string, string) {
+			return fmt.Sprintf("%s has an unfree license (%s) and nixpkgs refuses to build it", m[1], m[2]),
+				"set 'nixpkgs.config.allowUnfree = true;' or allow just this package with 'nixpkgs.config.allowUnfreePredicate'"
+		},
+	},
+	{
+		category: "insecure",
+		pattern:  regexp.MustCompile(`Package ‘([^’]+)’ in \S+ is marked as insecure, refusing to evaluate`),
+		explain: func(m []string) (string, string) {
+			return fmt.Sprintf("%s is marked as insecure and nixpkgs refuses to build it", m[1]),
+				fmt.Sprintf("if you accept the risk, add \"%s\" to 'nixpkgs.config.permittedInsecurePackages'", m[1])
+		},
+	},
+	{
+		category: "broken",
+		pattern:  regexp.MustCompile(`Package ‘([^’]+)’ in \S+ is marked as broken, refusing to evaluate`),
+		explain: func(m []string) (string, string) {
+			return fmt.Sprintf("%s is marked as broken in this nixpkgs revision", m[1]),
+				"remove it, pin an older nixpkgs for it, or set 'nixpkgs.config.allowBroken = true;' to try anyway"
+		},
+	},
+	{
+		category: "missing-attribute",
+		pattern:  regexp.MustCompile(`does not provide attribute '[^']*?(nixosConfigurations|homeConfigurations)\.("?)([^".']+)`),
+		explain: func(m []string) (string, string) {
+			if m[1] == "homeConfigurations" {
+				return fmt.Sprintf("the flake has no Home Manager configuration named %q", m[3]),
+					"pick the right one with 'no home -p <user@host>' or add it to homeConfigurations"
+			}
+			return fmt.Sprintf("the flake has no NixOS configuration named %q", m[3]),
+				"pick the right one with 'no rebuild -c <name>' or add it to nixosConfigurations"
+		},
+	},
+	{
+		category: "untracked-file",
+		pattern:  regexp.MustCompile(`(?:getting status of|path) '/nix/store/[a-z0-9]{32}-source/([^']+)'(?:: No such file or directory| does not exist)`),
+		explain: func(m []string) (string, string) {
+			return fmt.Sprintf("%s is not visible to the flake, most likely because git does not track it", m[1]),
+				fmt.Sprintf("flakes only see files known to git, run 'git add %s'", m[1])
+		},
+	},
+	{
+		category: "infinite-recursion",
+		pattern:  regexp.MustCompile(`infinite recursion encountered`),
+		explain: func(m []string) (string, string) {
+			return "evaluation ran into infinite recursion",
+				"usually an option defined in terms of itself, e.g. 'config' used inside 'imports'; build with '--show-trace' to see the chain"
+		},
+	},
+	{
+		category: "hash-mismatch",
+		pattern:  regexp.MustCompile(`hash mismatch in fixed-output derivation '([^']+)':\s+specified:\s+(\S+)\s+got:\s+(\S+)`),
+		explain: func(m []string) (string, string) {
+			return fmt.Sprintf("%s was fetched with a different hash than specified", derivationName(m[1])),
+				fmt.Sprintf("replace %s with %s if the new source is expected", m[2], m[3])
+		},
+	},
+	{
+		category: "disk-full",
+		pattern:  regexp.MustCompile(`No space left on device`),
+		explain: func(m []string) (string, string) {
+			return "the disk holding the nix store or build directory is full",
+				"free space with 'no garbage', or 'no garbage -b' to also drop old boot entries"
+		},
+	},
+	{
+		category: "substituter-unreachable",
+		pattern:  regexp.MustCompile(`unable to download '(https?://[^/']+)[^']*': (Couldn't resolve host name|Could not connect to server|Timeout was reached|Couldn't connect to server)`),
+		explain: func(m []string) (string, string) {
+			return fmt.Sprintf("could not reach %s (%s)", m[1], strings.ToLower(m[2])),
+				"check the network, or build without substituters using NIX_CONFIG='substitute = false'"
+		},
+	},
+}
+
+// Source locations in nix error traces, e.g.
+// "at /nix/store/<hash>-source/hosts/foo.nix:12:5:".
+var nixLocation = regexp.MustCompile(`at (?:/nix/store/[a-z0-9]{32}-source/)?([^\s:«»]+\.nix):(\d+):\d+`)
+
+// diagnose looks for known failure patterns in the output of a failed run.
+func diagnose(output string) []Diagnosis {
+	output = ansiEscape.ReplaceAllString(output, "")
+
+	var found []Diagnosis
+	for _, diag := range diagnostics {
+		idx := diag.pattern.FindStringSubmatchIndex(output)
+		if idx == nil {
+			continue
+		}
+
+		var match []string
+		for i := 0; i < len(idx); i += 2 {
+			if idx[i] < 0 {
+				match = append(match, "")
+				continue
+			}
+			match = append(match, output[idx[i]:idx[i+1]])
+		}
+
+		summary, fix := diag.explain(match)
+		found = append(found, Diagnosis{
+			Category: diag.category,
+			Summary:  summary,
+			Location: nearestLocation(output, idx[0]),
+			Fix:      fix,
+		})
+	}
+
+	return found
+}
+
+// nearestLocation finds the source location closest to offset that belongs to
+// the flake, reported relative to the flake directory.
+func nearestLocation(output string, offset int) string {
+	best := ""
+	bestDistance := -1
+
+	for _, idx := range nixLocation.FindAllStringSubmatchIndex(output, -1) {
+		file := output[idx[2]:idx[3]]
+		line := output[idx[4]:idx[5]]
+
+		if !filepath.IsAbs(file) {
+			if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+				continue
+			}
+		}
+
+		distance := idx[0] - offset
+		if distance < 0 {
+			distance = -distance
+		}
+		if bestDistance < 0 || distance < bestDistance {
+			best = file + ":" + line
+			bestDistance = distance
+		}
+	}
+
+	return best
+}
+
+func printDiagnoses(diagnoses []Diagnosis) {
+	for _, diagnosis := range diagnoses {
+		logger.Print(failureStyle.Render("✗") + " " + diagnosis.Summary)
+		if diagnosis.Location != "" {
+			logger.Print("    at " + diagnosis.Location)
+		}
+		logger.Print("    fix: " + diagnosis.Fix)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	dir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "hosts", "laptop"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"configuration.nix", "hosts/laptop/default.nix"} {
+		if err := os.WriteFile(filepath.Join(dir, file), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		output string
+		want   []Diagnosis
+	}{
+		{
+			name: "unfree",
+			output: `error:
+       … while evaluating the attribute 'config.system.build.toplevel'
+
+       … while calling the 'head' builtin
+         at /nix/store/0aa7vl6f10ljzk0h5y3rmz0dgg3k8w6c-source/lib/attrsets.nix:1575:11:
+         1574|         || pred here (elemAt values 1) (head values) then
+         1575|           head values
+             |           ^
+         1576|         else
+
+       … from call site
+         at /nix/store/xmqf6nfsfgcs5w0ndc0mrpq4k1x4f6b8-source/hosts/laptop/default.nix:12:5:
+           11|   environment.systemPackages = [
+           12|     pkgs.vscode
+             |     ^
+
+       error: Package ‘vscode-1.95.3’ in /nix/store/0aa7vl6f10ljzk0h5y3rmz0dgg3k8w6c-source/pkgs/applications/editors/vscode/vscode.nix:54 has an unfree license (‘unfree’), refusing to evaluate.`,
+			want: []Diagnosis{{
+				Category: "unfree",
+				Summary:  "vscode-1.95.3 has an unfree license (unfree) and nixpkgs refuses to build it",
+				Location: "hosts/laptop/default.nix:12",
+				Fix:      "set 'nixpkgs.config.allowUnfree = true;' or allow just this package with 'nixpkgs.config.allowUnfreePredicate'",
+			}},
+		},
+		{
+			name:   "insecure",
+			output: `       error: Package ‘openssl-1.1.1w’ in /nix/store/0aa7vl6f10ljzk0h5y3rmz0dgg3k8w6c-source/pkgs/development/libraries/openssl/default.nix:198 is marked as insecure, refusing to evaluate.`,
+			want: []Diagnosis{{
+				Category: "insecure",
+				Summary:  "openssl-1.1.1w is marked as insecure and nixpkgs refuses to build it",
+				Fix:      `if you accept the risk, add "openssl-1.1.1w" to 'nixpkgs.config.permittedInsecurePackages'`,
+			}},
+		},
+		{
+			name:   "broken",
+			output: `       error: Package ‘zfs-kernel-2.2.6-6.12.1’ in /nix/store/0aa7vl6f10ljzk0h5y3rmz0dgg3k8w6c-source/pkgs/os-specific/linux/zfs/generic.nix:223 is marked as broken, refusing to evaluate.`,
+			want: []Diagnosis{{
+				Category: "broken",
+				Summary:  "zfs-kernel-2.2.6-6.12.1 is marked as broken in this nixpkgs revision",
+				Fix:      "remove it, pin an older nixpkgs for it, or set 'nixpkgs.config.allowBroken = true;' to try anyway",
+			}},
+		},
+		{
+			name:   "missing NixOS configuration",
+			output: `error: flake 'git+file:///home/user/nixos' does not provide attribute 'packages.x86_64-linux.nixosConfigurations."laptop".config.system.build.toplevel', 'legacyPackages.x86_64-linux.nixosConfigurations."laptop".config.system.build.toplevel' or 'nixosConfigurations."laptop".config.system.build.toplevel'`,
+			want: []Diagnosis{{
+				Category: "missing-attribute",
+				Summary:  `the flake has no NixOS configuration named "laptop"`,
+				Fix:      "pick the right one with 'no rebuild -c <name>' or add it to nixosConfigurations",
+			}},
+		},
+		{
+			name:   "missing Home Manager configuration",
+			output: `error: flake 'git+file:///home/user/nixos' does not provide attribute 'packages.x86_64-linux.homeConfigurations."user@laptop".activationPackage', 'legacyPackages.x86_64-linux.homeConfigurations."user@laptop".activationPackage' or 'homeConfigurations."user@laptop".activationPackage'`,
+			want: []Diagnosis{{
+				Category: "missing-attribute",
+				Summary:  `the flake has no Home Manager configuration named "user@laptop"`,
+				Fix:      "pick the right one with 'no home -p <user@host>' or add it to homeConfigurations",
+			}},
+		},
+		{
+			name:   "untracked file",
+			output: `error: getting status of '/nix/store/5ycr0l8ncmx3x1jhmj0jv2p6dxgmqgqw-source/hosts/laptop/hardware.nix': No such file or directory`,
+			want: []Diagnosis{{
+				Category: "untracked-file",
+				Summary:  "hosts/laptop/hardware.nix is not visible to the flake, most likely because git does not track it",
+				Fix:      "flakes only see files known to git, run 'git add hosts/laptop/hardware.nix'",
+			}},
+		},
+		{
+			name:   "untracked file, newer nix",
+			output: `error: path '/nix/store/5ycr0l8ncmx3x1jhmj0jv2p6dxgmqgqw-source/modules/desktop.nix' does not exist`,
+			want: []Diagnosis{{
+				Category: "untracked-file",
+				Summary:  "modules/desktop.nix is not visible to the flake, most likely because git does not track it",
+				Fix:      "flakes only see files known to git, run 'git add modules/desktop.nix'",
+			}},
+		},
+		{
+			name: "infinite recursion",
+			output: `error:
+       … while evaluating the module argument 'pkgs' in "/nix/store/xmqf6nfsfgcs5w0ndc0mrpq4k1x4f6b8-source/configuration.nix":
+         at /nix/store/xmqf6nfsfgcs5w0ndc0mrpq4k1x4f6b8-source/configuration.nix:3:3:
+
+       error: infinite recursion encountered`,
+			want: []Diagnosis{{
+				Category: "infinite-recursion",
+				Summary:  "evaluation ran into infinite recursion",
+				Location: "configuration.nix:3",
+				Fix:      "usually an option defined in terms of itself, e.g. 'config' used inside 'imports'; build with '--show-trace' to see the chain",
+			}},
+		},
+		{
+			name: "hash mismatch",
+			output: `error: hash mismatch in fixed-output derivation '/nix/store/dvmig3vf5kvfh4w0ycpqrh0gh0jyrqjm-source.drv':
+         specified: sha256-AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+            got:    sha256-jM8+ulQ0B6SW7QFknTljQiVWqKkR0RLNi1VPW8dQ2RI=
+error: 1 dependencies of derivation '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-my-tool-1.0.drv' failed to build`,
+			want: []Diagnosis{{
+				Category: "hash-mismatch",
+				Summary:  "source was fetched with a different hash than specified",
+				Fix:      "replace sha256-AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA= with sha256-jM8+ulQ0B6SW7QFknTljQiVWqKkR0RLNi1VPW8dQ2RI= if the new source is expected",
+			}},
+		},
+		{
+			name:   "disk full",
+			output: `error: writing to file: No space left on device`,
+			want: []Diagnosis{{
+				Category: "disk-full",
+				Summary:  "the disk holding the nix store or build directory is full",
+				Fix:      "free space with 'no garbage', or 'no garbage -b' to also drop old boot entries",
+			}},
+		},
+		{
+			name:   "substituter unreachable",
+			output: `warning: error: unable to download 'https://cache.nixos.org/nix-cache-info': Couldn't resolve host name (6); retrying in 281 ms`,
+			want: []Diagnosis{{
+				Category: "substituter-unreachable",
+				Summary:  "could not reach https://cache.nixos.org (couldn't resolve host name)",
+				Fix:      "check the network, or build without substituters using NIX_CONFIG='substitute = false'",
+			}},
+		},
+		{
+			name:   "colored output",
+			output: "\x1b[31;1merror:\x1b[0m writing to file: No space left on device",
+			want: []Diagnosis{{
+				Category: "disk-full",
+				Summary:  "the disk holding the nix store or build directory is full",
+				Fix:      "free space with 'no garbage', or 'no garbage -b' to also drop old boot entries",
+			}},
+		},
+		{
+			name: "several failures",
+			output: `warning: error: unable to download 'https://cache.nixos.org/nix-cache-info': Could not connect to server (7)
+error: writing to file: No space left on device`,
+			want: []Diagnosis{
+				{
+					Category: "disk-full",
+					Summary:  "the disk holding the nix store or build directory is full",
+					Fix:      "free space with 'no garbage', or 'no garbage -b' to also drop old boot entries",
+				},
+				{
+					Category: "substituter-unreachable",
+					Summary:  "could not reach https://cache.nixos.org (could not connect to server)",
+					Fix:      "check the network, or build without substituters using NIX_CONFIG='substitute = false'",
+				},
+			},
+		},
+		{
+			name: "unknown failure",
+			output: `error: builder for '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-my-tool-1.0.drv' failed with exit code 2;
+       last 1 log lines:
+       > make: *** [Makefile:12: all] Error 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := diagnose(test.output)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("diagnose() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Escalator struct {
+	Name   string
+	Path   string
+	remote bool
+	// noPrompt makes escalation fail instead of asking for a password.
+	noPrompt bool
+	err      error
+}
+
+type EscalationError struct {
+	Escalator string
+	Err       error
+}
+
+func (e *EscalationError) Error() string {
+	return fmt.Sprintf("privilege escalation via %s failed: %s", e.Escalator, e.Err)
+}
+
+func (e *EscalationError) Unwrap() error {
+	return e.Err
+}
+
+var escalators = []string{"sudo", "doas", "run0"}
+
+// sudo forgets credentials after 5 minutes by default.
+const keepaliveInterval = time.Minute
+
+// Variables needed by nix to fetch private flake inputs as root.
+var preservedEnv = []string{"SSH_AUTH_SOCK", "NIX_CONFIG"}
+
+var escalator Escalator
+
+func newEscalator(name string) Escalator {
+	if os.Geteuid() == 0 {
+		return Escalator{Name: "none"}
+	}
+
+	switch name {
+	case "", "auto":
+		for _, candidate := range escalators {
+			if path, err := exec.LookPath(candidate); err == nil {
+				return Escalator{Name: candidate, Path: path}
+			}
+		}
+		return Escalator{
+			Name: "auto",
+			err: &EscalationError{
+				Escalator: "auto",
+				Err:       errors.New("none of " + strings.Join(escalators, ", ") + " found in PATH"),
+			},
+		}
+	case "none":
+		return Escalator{Name: "none"}
+	}
+
+	if !slices.Contains(escalators, name) {
+		return Escalator{
+			Name: name,
+			err: fmt.Errorf(
+				"escalation must be one of: auto, %s, none", strings.Join(escalators, ", ")),
+		}
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return Escalator{Name: name, err: &EscalationError{Escalator: name, Err: err}}
+	}
+
+	return Escalator{Name: name, Path: path}
+}
+
+func (e Escalator) Args(name string, args ...string) []string {
+	// The environment of this machine means nothing on a remote one.
+	var env []string
+	for _, key := range preservedEnv {
+		if _, ok := os.LookupEnv(key); ok && !e.remote {
+			env = append(env, key)
+		}
+	}
+
+	var argv []string
+	switch e.Name {
+	case "sudo":
+		argv = []string{e.Path}
+		if e.noPrompt {
+			argv = append(argv, "-n")
+		}
+		if len(env) > 0 {
+			argv = append(argv, "--preserve-env="+strings.Join(env, ","))
+		}
+	case "doas":
+		// doas can only keep variables named in doas.conf. Passing their
+		// values as arguments would expose tokens in NIX_CONFIG to every
+		// user through the process list.
+		argv = []string{e.Path}
+		if e.noPrompt {
+			argv = append(argv, "-n")
+		}
+	case "run0":
+		argv = []string{e.Path}
+		if e.noPrompt {
+			argv = append(argv, "--no-ask-password")
+		}
+		for _, key := range env {
+			argv = append(argv, "--setenv="+key)
+		}
+	}
+
+	argv = append(argv, name)
+	return append(argv, args...)
+}
+
+func (e Escalator) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	argv := e.Args(name, args...)
+	return command(ctx, argv[0], argv[1:]...)
+}
+
+// Validate makes sure escalation works before any privileged command is run,
+// so that an authentication failure is not mistaken for a failing command.
+func (e Escalator) Validate(ctx context.Context) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	var cmd *exec.Cmd
+	switch e.Name {
+	case "none":
+		return nil
+	case "sudo":
+		cmd = command(ctx, e.Path, "-v")
+	default:
+		cmd = command(ctx, e.Path, "true")
+	}
+
+	status.Pause()
+	defer status.Resume()
+
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return &EscalationError{Escalator: e.Name, Err: err}
+	}
+
+	return nil
+}
+
+// Keepalive validates credentials once up front and, for sudo, keeps the
+// timestamp fresh until the returned stop function is called. doas and run0
+// have no way to extend a cached authentication, so they are validated only.
+// The refresh loop stops with ctx and lives in this process, so it cannot
+// outlive no even when it is interrupted.
+func (e Escalator) Keepalive(ctx context.Context) (func(), error) {
+	if err := e.Validate(ctx); err != nil {
+		return func() {}, err
+	}
+
+	if e.Name != "sudo" {
+		return func() {}, nil
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := command(ctx, e.Path, "-n", "-v").Run(); err != nil {
+					logger.Warn("could not refresh sudo credentials", "err", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}, nil
+}
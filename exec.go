@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit code for runs stopped by SIGINT or SIGTERM, following the shell
+// convention for SIGINT.
+const exitInterrupted = 130
+
+// How long a child gets to exit after being signalled before it is killed.
+const terminateGracePeriod = 10 * time.Second
+
+type InterruptError struct {
+	Signal os.Signal
+}
+
+func (e *InterruptError) Error() string {
+	return "interrupted by " + e.Signal.String()
+}
+
+// signalContext returns the root context of a run. It is cancelled with an
+// *InterruptError cause on the first SIGINT or SIGTERM; a second signal falls
+// through to the default handler and stops no immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			logger.Warnf("Received %s, stopping... (repeat to force)", sig)
+			cancel(&InterruptError{Signal: sig})
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel(nil)
+	}
+}
+
+// interrupted reports the signal that cancelled ctx, if any.
+func interrupted(ctx context.Context) *InterruptError {
+	var interrupt *InterruptError
+	if errors.As(context.Cause(ctx), &interrupt) {
+		return interrupt
+	}
+	return nil
+}
+
+// command creates a child process tied to ctx. When ctx is done the child is
+// sent the signal that interrupted no (SIGTERM otherwise) and is killed if it
+// has not exited after terminateGracePeriod.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	cmd.Cancel = func() error {
+		var sig os.Signal = syscall.SIGTERM
+		if interrupt := interrupted(ctx); interrupt != nil {
+			sig = interrupt.Signal
+		}
+		return cmd.Process.Signal(sig)
+	}
+	cmd.WaitDelay = terminateGracePeriod
+
+	logger.Debug("exec", "argv", strings.Join(cmd.Args, " "), "dir", dir)
+
+	return cmd
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
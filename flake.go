@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type GitInfo struct {
+	Commit string
+	Branch string
+	Dirty  bool
+}
+
+func git(ctx context.Context, args ...string) (string, error) {
+	var out bytes.Buffer
+
+	cmd := command(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// flakeGitInfo describes the git checkout of the flake, or returns an error
+// when the flake is not in a git repository.
+func flakeGitInfo(ctx context.Context) (GitInfo, error) {
+	commit, err := git(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return GitInfo{}, err
+	}
+
+	// A detached HEAD has no branch.
+	branch, err := git(ctx, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil || branch == "HEAD" {
+		branch = ""
+	}
+
+	changes, err := git(ctx, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return GitInfo{}, err
+	}
+
+	return GitInfo{Commit: commit, Branch: branch, Dirty: changes != ""}, nil
+}
+
+// reportFlakeGitInfo describes the flake checkout in the report, if it is a
+// git repository.
+func reportFlakeGitInfo(ctx context.Context) {
+	if info, err := flakeGitInfo(ctx); err == nil {
+		report.FlakeCommit = info.Commit
+		report.FlakeBranch = info.Branch
+		report.FlakeDirty = info.Dirty
+	}
+}
+
+// flakeAtRev returns a flake reference to the flake as it was at rev, a
+// commit, branch or tag, read from git without touching the working tree.
+// The report then describes that commit instead of the checkout.
+func flakeAtRev(ctx context.Context, rev string) (string, error) {
+	commit, err := git(ctx, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%s is not a commit, branch or tag of %s", rev, dir)
+	}
+
+	toplevel, err := git(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("rev", commit)
+	// Without allRefs nix only finds commits reachable from HEAD.
+	query.Set("allRefs", "1")
+	if subdir, err := filepath.Rel(toplevel, dir); err == nil && subdir != "." {
+		query.Set("dir", subdir)
+	}
+
+	report.FlakeCommit = commit
+	report.FlakeDirty = false
+	report.FlakeBranch = ""
+	if _, err := git(ctx, "show-ref", "--verify", "--quiet", "refs/heads/"+rev); err == nil {
+		report.FlakeBranch = rev
+	}
+
+	return (&url.URL{Scheme: "git+file", Path: toplevel, RawQuery: query.Encode()}).String(), nil
+}
+
+// shortCommit abbreviates commit for display, marking uncommitted changes.
+func shortCommit(commit string, dirty bool) string {
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if dirty {
+		commit += "-dirty"
+	}
+	return commit
+}
+
+// fileOwner returns the uid owning path.
+func fileOwner(path string) (int, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("cannot tell who owns %s", path)
+	}
+	return int(stat.Uid), nil
+}
+
+// repairOwnership hands flake.lock back to the user when an earlier run of
+// nix as root left it owned by root. Nothing else in the flake directory is
+// touched, and only when the directory itself belongs to the user: a flake
+// owned by someone else, such as /etc/nixos, is not the user's to take. Such
+// a flake can only be updated asRoot, and only if root owns it.
+func repairOwnership(ctx context.Context, flakeDir string, asRoot bool) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	dirOwner, err := fileOwner(flakeDir)
+	if err != nil {
+		return err
+	}
+	if asRoot && dirOwner != 0 {
+		return fmt.Errorf("%s belongs to uid %d, not root; update it without --as-root so flake.lock does not end up owned by root", flakeDir, dirOwner)
+	}
+	if asRoot {
+		return nil
+	}
+	if dirOwner != os.Getuid() {
+		return fmt.Errorf("%s belongs to uid %d, but no update runs nix as you so that flake.lock stays yours; "+
+			"run it as the owner of the flake, or pass --as-root for a flake owned by root", flakeDir, dirOwner)
+	}
+
+	lockFile := filepath.Join(flakeDir, "flake.lock")
+
+	lockOwner, err := fileOwner(lockFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if lockOwner != 0 {
+		return nil
+	}
+
+	owner := strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())
+
+	logger.Warnf("%s is owned by root, changing owner to %s", lockFile, owner)
+
+	if err = escalator.Validate(ctx); err != nil {
+		return err
+	}
+
+	chownCmd := escalator.Command(ctx, "chown", "-h", owner, "--", lockFile)
+
+	chownCmd.Stdout = stdout
+	chownCmd.Stderr = stderr
+
+	if err = chownCmd.Run(); err != nil {
+		return fmt.Errorf("chown: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long no garbage keeps old generations, unless burning them all.
+const generationRetention = 7 * 24 * time.Hour
+
+// Generation is a generation of the system or Home Manager profile.
+type Generation struct {
+	Number  int       `json:"generation"`
+	Date    time.Time `json:"date"`
+	Current bool      `json:"current,omitempty"`
+	GenerationMeta
+}
+
+// GenerationMeta is what no records about a generation beyond the profile
+// itself.
+type GenerationMeta struct {
+	Pinned bool   `json:"pinned,omitempty"`
+	Note   string `json:"note,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Dirty  bool   `json:"dirty,omitempty"`
+}
+
+// generationsMeta maps profiles to the metadata of their generations.
+type generationsMeta map[string]map[int]GenerationMeta
+
+// The system profile is shared by every user of the machine, so what no
+// records about its generations is kept outside any home, writable by root.
+const systemStateDir = "/var/lib/no"
+
+// generationsPath returns the file recording the generations of profile:
+// one for the system in systemStateDir, and one in the state directory of
+// the user for their own profiles.
+func generationsPath(profile string) (string, error) {
+	if profile == systemProfile {
+		return filepath.Join(systemStateDir, "generations.json"), nil
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "generations.json"), nil
+}
+
+// generationsLock guards the file generationsPath returns for profile.
+func generationsLock(profile string) LockRequest {
+	if profile == systemProfile {
+		return LockRequest{Name: lockSystemGenerations, Block: true}
+	}
+	return LockRequest{Name: "generations", Block: true}
+}
+
+func readGenerationsMeta(profile string) (generationsMeta, error) {
+	path, err := generationsPath(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := generationsMeta{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return meta, nil
+}
+
+// updateGenerationsMeta changes the metadata recorded next to that of
+// profile with update, holding a lock so that concurrent runs do not lose
+// each other's changes. The system metadata is written as root.
+func updateGenerationsMeta(ctx context.Context, profile string, update func(meta generationsMeta)) error {
+	release, err := acquireLocks(ctx, generationsLock(profile))
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	meta, err := readGenerationsMeta(profile)
+	if err != nil {
+		return err
+	}
+
+	update(meta)
+
+	for profile, generations := range meta {
+		for number, generation := range generations {
+			if generation == (GenerationMeta{}) {
+				delete(generations, number)
+			}
+		}
+		if len(generations) == 0 {
+			delete(meta, profile)
+		}
+	}
+
+	path, err := generationsPath(profile)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if profile != systemProfile || os.Geteuid() == 0 {
+		if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, data, 0o644)
+	}
+
+	// Written to a temporary file first so that readers never see half of it.
+	cmd := escalator.Command(ctx, "sh", "-c", `mkdir -p "${1%/*}" && cat > "$1.tmp" && chmod 644 "$1.tmp" && mv "$1.tmp" "$1"`, "sh", path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// profileGenerations lists the generations of profile, oldest first, from
+// the generation links next to it.
+func profileGenerations(profile string) ([]Generation, error) {
+	entries, err := os.ReadDir(filepath.Dir(profile))
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := readGenerationsMeta(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	current := profileGeneration(profile)
+	prefix := filepath.Base(profile) + "-"
+
+	var generations []Generation
+	for _, entry := range entries {
+		number := linkGeneration(entry.Name())
+		if number == 0 || entry.Name() != prefix+strconv.Itoa(number)+"-link" {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		generations = append(generations, Generation{
+			Number:         number,
+			Date:           info.ModTime(),
+			Current:        number == current,
+			GenerationMeta: meta[profile][number],
+		})
+	}
+
+	slices.SortFunc(generations, func(a, b Generation) int {
+		return a.Number - b.Number
+	})
+	return generations, nil
+}
+
+// expiredGenerations returns the generations no garbage deletes: all but the
+// current and pinned ones when burning, otherwise only those older than the
+// retention.
+func expiredGenerations(generations []Generation, burn bool) []int {
+	var expired []int
+	for _, generation := range generations {
+		if generation.Current || generation.Pinned {
+			continue
+		}
+		if burn || time.Since(generation.Date) > generationRetention {
+			expired = append(expired, generation.Number)
+		}
+	}
+	return expired
+}
+
+// recordGeneration notes the flake commit of the run that created the
+// generation number of profile.
+func recordGeneration(ctx context.Context, profile string, number int) {
+	if number == 0 || report.FlakeCommit == "" {
+		return
+	}
+
+	err := updateGenerationsMeta(ctx, profile, func(meta generationsMeta) {
+		if meta[profile] == nil {
+			meta[profile] = map[int]GenerationMeta{}
+		}
+		generation := meta[profile][number]
+		generation.Commit = report.FlakeCommit
+		generation.Branch = report.FlakeBranch
+		generation.Dirty = report.FlakeDirty
+		meta[profile][number] = generation
+	})
+	if err != nil {
+		logger.Warn("could not record generation", "profile", profile, "err", err)
+	}
+}
+
+// deleteGenerations removes the generations numbers of profile, as root when
+// escalate is set, and forgets what was recorded about them.
+func deleteGenerations(ctx context.Context, profile string, numbers []int, escalate bool) error {
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	args := []string{"--profile", profile, "--delete-generations"}
+	for _, number := range numbers {
+		args = append(args, strconv.Itoa(number))
+	}
+
+	cmd := command(ctx, "nix-env", args...)
+	if escalate {
+		cmd = escalator.Command(ctx, "nix-env", args...)
+	}
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nix-env --delete-generations: %w", err)
+	}
+
+	return updateGenerationsMeta(ctx, profile, func(meta generationsMeta) {
+		for _, number := range numbers {
+			delete(meta[profile], number)
+		}
+	})
+}
+
+// pruneOtherProfiles deletes all but the current generation of every profile
+// besides the system and Home Manager ones, as nix-collect-garbage -d does:
+// those in /nix/var/nix/profiles and of root as root, then those of the
+// user. Only system and Home Manager generations can be pinned.
+func pruneOtherProfiles(ctx context.Context) error {
+	rootDirs := []string{"/nix/var/nix/profiles"}
+	if root, err := user.Lookup("root"); err == nil {
+		rootDirs = append(rootDirs, filepath.Join(root.HomeDir, ".local", "state", "nix", "profiles"))
+	}
+
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, _ := os.UserHomeDir()
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	userDir := filepath.Join(stateHome, "nix", "profiles")
+
+	for _, dir := range rootDirs {
+		for _, profile := range listProfiles(ctx, dir, true) {
+			if err := deleteOldGenerations(ctx, profile, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	if slices.Contains(rootDirs, userDir) {
+		return nil
+	}
+	for _, profile := range listProfiles(ctx, userDir, false) {
+		if err := deleteOldGenerations(ctx, profile, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listProfiles returns the profiles below dir apart from the system and
+// Home Manager ones, reading dir as root when escalate is set.
+func listProfiles(ctx context.Context, dir string, escalate bool) []string {
+	cmd := command(ctx, "find", dir, "-type", "l")
+	if escalate {
+		cmd = escalator.Command(ctx, "find", dir, "-type", "l")
+	}
+
+	// A directory that does not exist only leaves the output empty.
+	out, _ := cmd.Output()
+
+	var profiles []string
+	for _, path := range strings.Split(string(out), "\n") {
+		if path == "" || linkGeneration(filepath.Base(path)) != 0 {
+			continue
+		}
+		if path == systemProfile || path == homeProfile() {
+			continue
+		}
+		profiles = append(profiles, path)
+	}
+	return profiles
+}
+
+// deleteOldGenerations removes all but the current generation of profile, as
+// root when escalate is set.
+func deleteOldGenerations(ctx context.Context, profile string, escalate bool) error {
+	args := []string{"--profile", profile, "--delete-generations", "old"}
+
+	cmd := command(ctx, "nix-env", args...)
+	if escalate {
+		cmd = escalator.Command(ctx, "nix-env", args...)
+	}
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nix-env --delete-generations: %w", err)
+	}
+	return nil
+}
+
+func generationsCmd(ctx context.Context, args []string) error {
+	var home bool
+	var note string
+
+	flagSet := flag.NewFlagSet("generations", flag.ExitOnError)
+	flagSet.BoolVar(&home, "home", false, "Home Manager generations")
+	flagSet.StringVar(&note, "note", "", "why the generation is pinned")
+	flagSet.StringVar(&note, "n", "", "why the generation is pinned")
+	flagSet.Usage = func() {
+		logger.Print(`List generations and pin them.
+
+Usage:
+
+    no generations [flags]
+    no generations pin [flags] <generation>
+    no generations unpin [flags] <generation>
+
+Generations created by no show the flake commit they were built from.
+Pinned generations are never deleted by no garbage, not even with --burn.
+
+Flags:
+
+    --home  BOOL
+        Use the Home Manager profile instead of the system one.
+
+    -n, --note  STRING
+        Why the generation is pinned, shown by no generations.
+
+    -h, --help
+        Print this help.
+
+Examples:
+
+    Keep the last known-good system before a big upgrade
+        no generations pin -n "before 25.05" 412`)
+	}
+	flagSet.Parse(args)
+
+	// Flags may also follow pin and unpin.
+	subCmd := flagSet.Arg(0)
+	if subCmd == "pin" || subCmd == "unpin" {
+		flagSet.Parse(flagSet.Args()[1:])
+	}
+
+	profile := systemProfile
+	if home {
+		profile = homeProfile()
+	}
+
+	generations, err := profileGenerations(profile)
+	if err != nil {
+		return err
+	}
+
+	switch subCmd {
+	case "pin", "unpin":
+		number, err := strconv.Atoi(flagSet.Arg(0))
+		if err != nil || flagSet.NArg() != 1 {
+			return fmt.Errorf("usage: no generations %s <generation>", subCmd)
+		}
+
+		if !slices.ContainsFunc(generations, func(generation Generation) bool {
+			return generation.Number == number
+		}) {
+			return fmt.Errorf("%s has no generation %d", profile, number)
+		}
+
+		err = updateGenerationsMeta(ctx, profile, func(meta generationsMeta) {
+			if meta[profile] == nil {
+				meta[profile] = map[int]GenerationMeta{}
+			}
+			generation := meta[profile][number]
+			generation.Pinned = subCmd == "pin"
+			generation.Note = ""
+			if generation.Pinned {
+				generation.Note = note
+			}
+			meta[profile][number] = generation
+		})
+		if err != nil {
+			return err
+		}
+
+		action := "Pinned"
+		if subCmd == "unpin" {
+			action = "Unpinned"
+		}
+		logger.Info(action + " generation " + strconv.Itoa(number) + " of " + profile)
+		return nil
+	case "", "list":
+	default:
+		return fmt.Errorf("unknown generations command %q", subCmd)
+	}
+
+	if outputFormat == "json" {
+		if generations == nil {
+			generations = []Generation{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(generations)
+	}
+
+	for _, generation := range generations {
+		marks := ""
+		if generation.Current {
+			marks += "current "
+		}
+		if generation.Pinned {
+			marks += "pinned "
+		}
+
+		fmt.Fprintf(os.Stdout, "%5d  %s  %-18s %-15s %s\n",
+			generation.Number,
+			generation.Date.Local().Format(time.DateTime),
+			shortCommit(generation.Commit, generation.Dirty),
+			marks,
+			generation.Note)
+	}
+
+	return nil
+}
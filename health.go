@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HealthCheck is a check run on a host after it was activated:
+//
+//   - failed-units: no systemd unit is in the failed state
+//   - unit: Unit is active
+//   - http: URL answers with a 2xx status, {host} standing for the host
+//   - command: Command exits 0 when run on the host
+//
+// A check is retried until it passes or Timeout runs out, so services get
+// some time to come up.
+type HealthCheck struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Unit    string   `json:"unit"`
+	URL     string   `json:"url"`
+	Command string   `json:"command"`
+	Timeout Duration `json:"timeout"`
+}
+
+type CheckResult struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthError struct {
+	Host       string
+	Failed     []string
+	RolledBack bool
+}
+
+func (e *HealthError) Error() string {
+	msg := fmt.Sprintf("health checks failed on %s: %s", e.Host, strings.Join(e.Failed, ", "))
+	if e.RolledBack {
+		msg += ", rolled back to the previous generation"
+	}
+	return msg
+}
+
+var defaultHealthChecks = []HealthCheck{{Type: "failed-units"}}
+
+const (
+	healthCheckInterval = 2 * time.Second
+	httpCheckTimeout    = 10 * time.Second
+)
+
+// healthChecks returns the checks for the configuration hostName: its own
+// from the inventory, else those of the config, else the default ones.
+func healthChecks(hostName string) []HealthCheck {
+	if checks := config.Hosts[hostName].HealthChecks; len(checks) > 0 {
+		return checks
+	}
+	if len(config.HealthChecks) > 0 {
+		return config.HealthChecks
+	}
+	return defaultHealthChecks
+}
+
+func (c HealthCheck) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	switch c.Type {
+	case "unit":
+		return "unit " + c.Unit
+	case "http":
+		return "http " + c.URL
+	case "command":
+		return "command " + c.Command
+	}
+	return c.Type
+}
+
+// run checks once.
+func (c HealthCheck) run(ctx context.Context, target Target) error {
+	switch c.Type {
+	case "failed-units":
+		out, err := target.Output(ctx, "systemctl", "list-units", "--failed", "--plain", "--no-legend", "--no-pager")
+		if err != nil {
+			return err
+		}
+
+		var units []string
+		for _, line := range strings.Split(out, "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				units = append(units, fields[0])
+			}
+		}
+
+		if len(units) > 0 {
+			return fmt.Errorf("failed units: %s", strings.Join(units, ", "))
+		}
+		return nil
+	case "unit":
+		var out bytes.Buffer
+
+		cmd := target.Command(ctx, "systemctl", "is-active", c.Unit)
+		cmd.Stdout = &out
+		_, cmd.Stderr = target.outputs()
+
+		if err := cmd.Run(); err != nil {
+			if state := strings.TrimSpace(out.String()); state != "" {
+				return fmt.Errorf("%s is %s", c.Unit, state)
+			}
+			return err
+		}
+		return nil
+	case "http":
+		host := "localhost"
+		if !target.Local() {
+			host = target.Host[strings.LastIndex(target.Host, "@")+1:]
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, httpCheckTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(c.URL, "{host}", host), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	case "command":
+		cmd := target.Command(ctx, "sh", "-c", c.Command)
+		cmd.Stdout, cmd.Stderr = target.outputs()
+		return cmd.Run()
+	}
+
+	return fmt.Errorf("health check type must be one of: failed-units, unit, http, command")
+}
+
+// check runs the check until it passes or its timeout runs out.
+func (c HealthCheck) check(ctx context.Context, target Target) error {
+	deadline := time.Now().Add(c.Timeout.Duration)
+
+	for {
+		err := c.run(ctx, target)
+		if err == nil || ctx.Err() != nil || time.Now().After(deadline) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(healthCheckInterval):
+		}
+	}
+}
+
+// runHealthChecks runs every check on target and prints how each went. It
+// returns a *HealthError naming the checks that failed.
+func runHealthChecks(ctx context.Context, target Target, checks []HealthCheck) ([]CheckResult, error) {
+	out, _ := target.outputs()
+
+	var results []CheckResult
+	var failed []string
+
+	for _, check := range checks {
+		err := check.check(ctx, target)
+		if ctx.Err() != nil {
+			return results, context.Cause(ctx)
+		}
+
+		result := CheckResult{Check: check.String(), Passed: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			failed = append(failed, result.Check)
+			fmt.Fprintln(out, failureStyle.Render("✗")+" "+result.Check+": "+result.Error)
+		} else {
+			fmt.Fprintln(out, successStyle.Render("✓")+" "+result.Check)
+		}
+
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, &HealthError{Host: target.String(), Failed: failed}
+	}
+	return results, nil
+}
+
+// withFailedUnits adds the units that failed during the activation to the
+// results of the health checks as a failed check of its own, so that they
+// are rolled back like any other failure.
+func withFailedUnits(target Target, results []CheckResult, err error, unitsErr *FailedUnitsError) ([]CheckResult, error) {
+	var healthErr *HealthError
+	if unitsErr == nil || (err != nil && !errors.As(err, &healthErr)) {
+		return results, err
+	}
+	if healthErr == nil {
+		healthErr = &HealthError{Host: target.String()}
+	}
+
+	result := CheckResult{Check: "activation", Error: unitsErr.Error()}
+	out, _ := target.outputs()
+	fmt.Fprintln(out, failureStyle.Render("✗")+" "+result.Check+": "+result.Error)
+	healthErr.Failed = append([]string{result.Check}, healthErr.Failed...)
+
+	return append([]CheckResult{result}, results...), healthErr
+}
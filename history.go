@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type HistoryEntry struct {
+	ID int `json:"id"`
+	*Report
+}
+
+func historyPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "history.jsonl"), nil
+}
+
+// appendHistory records a finished run. Entries are numbered in order and
+// never rewritten.
+func appendHistory(r *Report) error {
+	release, err := acquireLocks(context.Background(), LockRequest{Name: "history", Block: true})
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	entries, err := readHistory()
+	if err != nil {
+		return err
+	}
+
+	id := 1
+	if len(entries) > 0 {
+		id = entries[len(entries)-1].ID + 1
+	}
+
+	data, err := json.Marshal(HistoryEntry{ID: id, Report: r})
+	if err != nil {
+		return err
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+func readHistory() ([]HistoryEntry, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		entry := HistoryEntry{Report: &Report{}}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logger.Warn("skipping unreadable history entry", "err", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// result is what a run produced: the generation it activated, or the last
+// store path it built.
+func (e HistoryEntry) result() string {
+	if e.GenerationAfter > 0 {
+		return "generation " + strconv.Itoa(e.GenerationAfter)
+	}
+	if len(e.StorePaths) > 0 {
+		return e.StorePaths[len(e.StorePaths)-1]
+	}
+	return ""
+}
+
+func (e HistoryEntry) outcome() string {
+	if e.ExitStatus == 0 {
+		return "ok"
+	}
+	return e.ErrorCategory
+}
+
+func (e HistoryEntry) commit() string {
+	return shortCommit(e.FlakeCommit, e.FlakeDirty)
+}
+
+func historyCmd(_ context.Context, args []string) error {
+	var (
+		limit   int
+		command string
+		target  string
+		failed  bool
+	)
+
+	flagSet := flag.NewFlagSet("history", flag.ExitOnError)
+	flagSet.IntVar(&limit, "limit", 20, "number of runs to list")
+	flagSet.IntVar(&limit, "n", 20, "number of runs to list")
+	flagSet.StringVar(&command, "command", "", "only list this command")
+	flagSet.StringVar(&command, "c", "", "only list this command")
+	flagSet.StringVar(&target, "target", "", "only list this target")
+	flagSet.StringVar(&target, "t", "", "only list this target")
+	flagSet.BoolVar(&failed, "failed", false, "only list failed runs")
+	flagSet.BoolVar(&failed, "f", false, "only list failed runs")
+	flagSet.Usage = func() {
+		logger.Print(`List previous runs.
+
+Usage:
+
+    no history [flags]
+    no history show <id>
+
+Every garbage, home, rebuild and update run is recorded with the flake
+commit it was run from, what it built or activated and how it ended.
+
+Flags:
+
+    -c, --command  STRING
+        Only list runs of this command.
+
+    -f, --failed  BOOL
+        Only list failed runs.
+
+    -n, --limit  INT
+        Number of runs to list, 0 for all. (default '20')
+
+    -t, --target  STRING
+        Only list runs for this host or profile.
+
+    -h, --help
+        Print this help.
+
+Examples:
+
+    What was last deployed to this machine, and from which commit
+        no history -c rebuild -n 1
+
+    Show everything about run 42, including its log
+        no history show 42`)
+	}
+	flagSet.Parse(args)
+
+	entries, err := readHistory()
+	if err != nil {
+		return err
+	}
+
+	if flagSet.Arg(0) == "show" {
+		id, err := strconv.Atoi(flagSet.Arg(1))
+		if err != nil {
+			return fmt.Errorf("usage: no history show <id>")
+		}
+
+		idx := slices.IndexFunc(entries, func(entry HistoryEntry) bool {
+			return entry.ID == id
+		})
+		if idx < 0 {
+			return fmt.Errorf("no run with id %d in history", id)
+		}
+
+		return showHistoryEntry(entries[idx])
+	}
+
+	entries = slices.DeleteFunc(entries, func(entry HistoryEntry) bool {
+		return (command != "" && entry.Command != command) ||
+			(target != "" && entry.Target != target) ||
+			(failed && entry.ExitStatus == 0)
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	if outputFormat == "json" {
+		if entries == nil {
+			entries = []HistoryEntry{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+
+	for _, entry := range entries {
+		fmt.Fprintf(os.Stdout, "%5d  %s  %-8s %-20s %-18s %-10s %s\n",
+			entry.ID,
+			entry.Start.Local().Format(time.DateTime),
+			entry.Command,
+			entry.Target,
+			entry.commit(),
+			entry.outcome(),
+			entry.result())
+	}
+
+	return nil
+}
+
+func showHistoryEntry(entry HistoryEntry) error {
+	if outputFormat == "json" {
+		return json.NewEncoder(os.Stdout).Encode(entry)
+	}
+
+	field := func(name string, value any) {
+		if value != "" && value != 0 {
+			fmt.Fprintf(os.Stdout, "%-18s %v\n", name+":", value)
+		}
+	}
+
+	field("id", entry.ID)
+	field("started", entry.Start.Local().Format(time.DateTime))
+	field("duration", (time.Duration(entry.Duration * float64(time.Second))).Round(time.Second).String())
+	field("command", entry.Command)
+	field("args", fmt.Sprint(entry.Args))
+	field("flake", entry.Flake)
+	field("commit", entry.commit())
+	field("target", entry.Target)
+	field("operation", entry.Operation)
+	field("generation before", entry.GenerationBefore)
+	field("generation after", entry.GenerationAfter)
+	for _, path := range entry.StorePaths {
+		field("store path", path)
+	}
+	for _, phase := range entry.Phases {
+		field("phase "+string(phase.Phase), (time.Duration(phase.Duration * float64(time.Second))).Round(time.Second).String())
+	}
+	field("outcome", entry.outcome())
+	field("exit status", entry.ExitStatus)
+	field("error", entry.Error)
+
+	if entry.Log != "" {
+		if _, err := os.Stat(entry.Log); err != nil {
+			field("log", entry.Log+" (rotated away)")
+		} else {
+			field("log", entry.Log)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Operation classes that must not run concurrently with themselves. A flake
+// lock is taken in addition, exclusively while flake.lock is being changed and
+// shared while the flake is only read.
+const (
+	lockSystem = "system"
+	lockHome   = "home"
+	lockGC     = "gc"
+)
+
+// Guards what no records about system generations, for all users.
+const lockSystemGenerations = "system-generations"
+
+const lockPollInterval = 250 * time.Millisecond
+
+// Locks guarding the machine or a flake rather than files of one user are
+// kept in a directory every user shares, so that runs of different users
+// exclude each other too. Like /tmp it is world-writable and sticky.
+const sharedLockDir = "/run/no"
+
+// How long to wait for a held lock, zero meaning fail immediately.
+var lockWait time.Duration
+
+type Lock struct {
+	file   *os.File
+	shared bool
+}
+
+type LockedError struct {
+	Name   string
+	Holder string
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == "" {
+		return fmt.Sprintf("%s lock is held by another no process", e.Name)
+	}
+	return fmt.Sprintf("%s lock is held by %s", e.Name, e.Holder)
+}
+
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "no")
+	}
+	return filepath.Join(os.TempDir(), "no-"+strconv.Itoa(os.Getuid()))
+}
+
+// lockDir returns the directory holding the lock name: the shared one for
+// locks on the system, its generations, gc, flakes and hosts, and the runtime
+// directory of the user for everything else.
+func lockDir(ctx context.Context, name string) (string, error) {
+	machine := name == lockSystem || name == lockGC || name == lockSystemGenerations
+	shared := machine || strings.HasPrefix(name, "flake-") || strings.HasPrefix(name, "host-")
+	if !shared {
+		dir := runtimeDir()
+		return dir, os.MkdirAll(dir, 0o700)
+	}
+
+	if _, err := os.Stat(sharedLockDir); !errors.Is(err, fs.ErrNotExist) {
+		return sharedLockDir, err
+	}
+
+	// Flake and host locks are also taken by runs that never need root, like
+	// no home or no deploy, which must not ask for a password only to create
+	// the directory. Until it exists they only keep out runs of the same user.
+	if !machine {
+		dir := runtimeDir()
+		return dir, os.MkdirAll(dir, 0o700)
+	}
+
+	// Only root can create it in /run, which is cleared on boot.
+	var cmd *exec.Cmd
+	if os.Geteuid() == 0 {
+		cmd = command(ctx, "mkdir", "-p", "-m", "1777", sharedLockDir)
+	} else {
+		cmd = escalator.Command(ctx, "mkdir", "-p", "-m", "1777", sharedLockDir)
+	}
+
+	status.Pause()
+	defer status.Resume()
+
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("creating %s: %w", sharedLockDir, err)
+	}
+	return sharedLockDir, nil
+}
+
+// flakeLock identifies the flake in dir by its absolute path.
+func flakeLock(shared bool) (LockRequest, error) {
+	flakeDir, err := filepath.Abs(dir)
+	if err != nil {
+		return LockRequest{}, err
+	}
+
+	sum := sha256.Sum256([]byte(flakeDir))
+	return LockRequest{Name: "flake-" + hex.EncodeToString(sum[:8]), Shared: shared}, nil
+}
+
+// hostLock serializes activations on a remote host, the counterpart of the
+// system lock for this machine.
+func hostLock(host string) LockRequest {
+	sum := sha256.Sum256([]byte(host))
+	return LockRequest{Name: "host-" + hex.EncodeToString(sum[:8])}
+}
+
+// acquireLock takes the advisory lock name, waiting up to lockWait for other
+// no processes to release it, or for as long as it takes when block is set.
+func acquireLock(ctx context.Context, name string, shared, block bool) (*Lock, error) {
+	dir, err := lockDir(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := openLockFile(filepath.Join(dir, name+".lock"), dir == sharedLockDir)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	deadline := time.Now().Add(lockWait)
+	waiting := false
+
+	if block {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	for !block {
+		err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, err
+		}
+
+		holder := lockHolder(file)
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, &LockedError{Name: name, Holder: holder}
+		}
+		if !waiting {
+			logger.Infof("Waiting for %s lock held by %s...", name, holder)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, context.Cause(ctx)
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	if !shared {
+		file.Truncate(0)
+		file.WriteAt([]byte(fmt.Sprintf("pid %d: %s\n", os.Getpid(), strings.Join(os.Args, " "))), 0)
+	}
+
+	return &Lock{file: file, shared: shared}, nil
+}
+
+// openLockFile opens the lock file at path, creating it if needed. An
+// existing file is never opened with O_CREAT: in a sticky directory like
+// /run/no, fs.protected_regular refuses that for files of other users, even
+// to root. A file created for other users is made writable by them, whatever
+// the umask.
+func openLockFile(path string, shared bool) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return file, err
+		}
+
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			// Another run created it in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if shared {
+			if err = file.Chmod(0o666); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		return file, nil
+	}
+}
+
+func lockHolder(file *os.File) string {
+	data := make([]byte, 4096)
+	n, _ := file.ReadAt(data, 0)
+	return strings.TrimSpace(string(data[:n]))
+}
+
+func (l *Lock) Release() {
+	if l == nil {
+		return
+	}
+	if !l.shared {
+		l.file.Truncate(0)
+	}
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+type LockRequest struct {
+	Name   string
+	Shared bool
+	// Block waits for the lock regardless of lockWait. It is meant for the
+	// locks no holds only briefly to update its own files, which a run must
+	// never fail on.
+	Block bool
+}
+
+// acquireLocks takes every requested lock in order and returns a function
+// releasing all of them. Callers request flake, system, home and gc locks in
+// that order so that two runs cannot deadlock.
+func acquireLocks(ctx context.Context, requests ...LockRequest) (func(), error) {
+	var locks []*Lock
+	release := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Release()
+		}
+	}
+
+	for _, request := range requests {
+		lock, err := acquireLock(ctx, request.Name, request.Shared, request.Block)
+		if err != nil {
+			release()
+			return func() {}, err
+		}
+		locks = append(locks, lock)
+	}
+
+	return release, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/muesli/termenv"
+)
+
+var (
+	logLevel      string
+	logFormat     string
+	logTimestamps bool
+	colorMode     string
+)
+
+var logFormatters = map[string]log.Formatter{
+	"text":   log.TextFormatter,
+	"logfmt": log.LogfmtFormatter,
+	"json":   log.JSONFormatter,
+}
+
+// configureLogger applies the log flags, falling back to the config, to the
+// logger and to every other place no writes styled output.
+func configureLogger() error {
+	if logLevel == "" {
+		logLevel = config.LogLevel
+	}
+	if logFormat == "" {
+		logFormat = config.LogFormat
+	}
+	if colorMode == "" {
+		colorMode = config.Color
+	}
+	logTimestamps = logTimestamps || config.LogTimestamps
+
+	if logLevel != "" {
+		level, err := log.ParseLevel(logLevel)
+		if err != nil {
+			return fmt.Errorf("log level must be one of: debug, info, warn, error")
+		}
+		logger.SetLevel(level)
+	}
+
+	if logFormat != "" {
+		formatter, ok := logFormatters[logFormat]
+		if !ok {
+			return fmt.Errorf("log format must be one of: text, logfmt, json")
+		}
+		logger.SetFormatter(formatter)
+	}
+
+	logger.SetReportTimestamp(logTimestamps)
+
+	switch colorMode {
+	case "", "auto":
+		if _, ok := os.LookupEnv("NO_COLOR"); ok {
+			setColorProfile(termenv.Ascii)
+		}
+	case "always":
+		setColorProfile(termenv.TrueColor)
+	case "never":
+		setColorProfile(termenv.Ascii)
+		os.Setenv("NO_COLOR", "1")
+	default:
+		return fmt.Errorf("color must be one of: auto, always, never")
+	}
+
+	logger.Debug("environment", "env", strings.Join(os.Environ(), " "))
+
+	return nil
+}
+
+func setColorProfile(profile termenv.Profile) {
+	logger.SetColorProfile(profile)
+	stderrRenderer.SetColorProfile(profile)
+}
+
+// setEnv adds environment variables to cmd on top of the inherited ones and
+// shows them in debug logs.
+func setEnv(cmd *exec.Cmd, env ...string) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
+
+	logger.Debug("exec environment", "argv", strings.Join(cmd.Args, " "), "env", strings.Join(env, " "))
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"os/user"
+	"path/filepath"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 )
@@ -14,7 +19,8 @@ import (
 type Command struct {
 	Name string
 	Help string
-	Run  func(args []string) error
+	Run  func(ctx context.Context, args []string) error
+	Log  bool
 }
 
 type Operation struct {
@@ -25,27 +31,69 @@ type Operation struct {
 var err error
 var logger = log.New(os.Stderr)
 var dir string
+var escalation string
 
 var commands = []Command{
+	{
+		Name: "activate",
+		Help: "Activate a system staged by rebuild --stage",
+		Run:  activateCmd,
+		Log:  true,
+	},
+	{
+		Name: "deploy",
+		Help: "Deploy NixOS configurations to several machines",
+		Run:  deployCmd,
+		Log:  true,
+	},
 	{
 		Name: "garbage",
 		Help: "Run garbage collection and remove old generations",
 		Run:  garbageCmd,
+		Log:  true,
+	},
+	{
+		Name: "generations",
+		Help: "List generations and pin them",
+		Run:  generationsCmd,
 	},
 	{
 		Name: "home",
 		Help: "Rebuild a Home Manager configuration",
 		Run:  homeCmd,
+		Log:  true,
 	},
 	{
 		Name: "rebuild",
 		Help: "Rebuild a NixOS configuration",
 		Run:  rebuildCmd,
+		Log:  true,
 	},
 	{
 		Name: "update",
 		Help: "Update a flake.lock file",
 		Run:  updateCmd,
+		Log:  true,
+	},
+	{
+		Name: "roots",
+		Help: "Keep store paths from garbage collection",
+		Run:  rootsCmd,
+	},
+	{
+		Name: "status",
+		Help: "Show the running system and whether a reboot is required",
+		Run:  statusCmd,
+	},
+	{
+		Name: "history",
+		Help: "List previous runs",
+		Run:  historyCmd,
+	},
+	{
+		Name: "logs",
+		Help: "Show logs of previous runs",
+		Run:  logsCmd,
 	},
 	{
 		Name: "help",
@@ -54,12 +102,23 @@ var commands = []Command{
 	},
 }
 
-func printHelpCmd(_ []string) error {
+// flagPassed reports whether the flag name was given on the command line.
+func flagPassed(flagSet *flag.FlagSet, name string) bool {
+	passed := false
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+func printHelpCmd(_ context.Context, _ []string) error {
 	flag.Usage()
 	return nil
 }
 
-func garbageCmd(args []string) error {
+func garbageCmd(ctx context.Context, args []string) error {
 	var burn bool
 
 	flagSet := flag.NewFlagSet("garbage", flag.ExitOnError)
@@ -72,6 +131,11 @@ Usage:
 
     no garbage [flags]
 
+System and Home Manager generations older than 7 days are deleted, or all
+but the current one with --burn. Generations pinned with no generations pin
+are always kept. Of other profiles, like nix profile, nix-env and channels,
+only the current generation is kept, as with nix-collect-garbage -d.
+
 Flags:
 
     -b, --burn  BOOL
@@ -82,69 +146,81 @@ Flags:
 	}
 	flagSet.Parse(args)
 
-	logger.Info("Starting system cleanup...")
-
-	sysTrashCmd := exec.Command("sudo", "nix-collect-garbage", "-d")
-
-	sysTrashCmd.Stdout = os.Stdout
-	sysTrashCmd.Stderr = os.Stdout
-
-	err = sysTrashCmd.Run()
+	release, err := acquireLocks(ctx,
+		LockRequest{Name: lockSystem},
+		LockRequest{Name: lockHome},
+		LockRequest{Name: lockGC})
+	defer release()
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	userTrashCmd := exec.Command("nix-collect-garbage", "-d")
-
-	userTrashCmd.Stdout = os.Stdout
-	userTrashCmd.Stderr = os.Stdout
-
-	err = userTrashCmd.Run()
+	stopKeepalive, err := escalator.Keepalive(ctx)
+	defer stopKeepalive()
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	switch burn {
-	case false:
-		profileCmd := exec.Command(
-			"sudo",
-			"nix",
-			"profile",
-			"wipe-history",
-			"--profile",
-			"/nix/var/nix/profiles/system",
-			"--older-than",
-			"7d")
+	logger.Info("Starting system cleanup...")
 
-		profileCmd.Stdout = os.Stdout
-		profileCmd.Stderr = os.Stdout
+	return runPhase(ctx, phaseGC, func(ctx context.Context) error {
+		// Old generations are deleted one by one rather than with
+		// nix-collect-garbage -d, which would also take pinned ones.
+		systemGenerations, err := profileGenerations(systemProfile)
+		if err != nil {
+			return err
+		}
 
-		err = profileCmd.Run()
+		err = deleteGenerations(ctx, systemProfile, expiredGenerations(systemGenerations, burn), true)
 		if err != nil {
-			logger.Fatal(err)
+			return err
 		}
 
-	case true:
-		logger.Warn("BURN ORDER ACTIVATED")
-		logger.Print("purging all previous system configurations from boot...")
-		profileBurnCmd := exec.Command(
-			"sudo",
-			"/run/current-system/bin/switch-to-configuration",
-			"boot")
+		homeGenerations, err := profileGenerations(homeProfile())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
 
-		profileBurnCmd.Stdout = os.Stdout
-		profileBurnCmd.Stderr = os.Stderr
+		err = deleteGenerations(ctx, homeProfile(), expiredGenerations(homeGenerations, burn), false)
+		if err != nil {
+			return err
+		}
 
-		err = profileBurnCmd.Run()
+		if err = pruneOtherProfiles(ctx); err != nil {
+			return err
+		}
+
+		trashCmd := escalator.Command(ctx, "nix-collect-garbage")
+
+		trashCmd.Stdout = stdout
+		trashCmd.Stderr = stderr
+
+		err = trashCmd.Run()
 		if err != nil {
-			logger.Fatal(err)
+			return fmt.Errorf("nix-collect-garbage: %w", err)
 		}
-	}
 
-	return nil
+		if burn {
+			logger.Warn("BURN ORDER ACTIVATED")
+			logger.Print("purging all previous system configurations from boot...")
+			profileBurnCmd := escalator.Command(ctx,
+				"/run/current-system/bin/switch-to-configuration",
+				"boot")
+
+			profileBurnCmd.Stdout = stdout
+			profileBurnCmd.Stderr = stderr
+
+			err = profileBurnCmd.Run()
+			if err != nil {
+				return fmt.Errorf("switch-to-configuration: %w", err)
+			}
+		}
+
+		return nil
+	})
 }
 
-func homeCmd(args []string) error {
+func homeCmd(ctx context.Context, args []string) error {
 	var operation = "switch"
 	var operations = []Operation{
 		{
@@ -207,6 +283,9 @@ func homeCmd(args []string) error {
 	flagSet.StringVar(&profile, "profile", profile, "home-manager profile")
 	flagSet.StringVar(&profile, "p", profile, "home-manager profile")
 
+	var rev string
+	flagSet.StringVar(&rev, "rev", "", "build the flake as of this git revision")
+
 	flagSet.Usage = func() {
 		logger.Print(`Manage a Home Manager configuration.
 
@@ -222,38 +301,54 @@ Flags:
     -p, --profile  STRING
         Home Manager profile to use. (default 'user@host')
 
+    --rev  COMMIT|BRANCH|TAG
+        Build the configuration as it was at this git revision of the flake,
+        leaving the working tree alone.
+
     -h, --help
         Print this help.
 
 Examples:
 
     Build a configuration for the specified profile
-        no home -o build -p <user>-<host>`)
+        no home -o build -p <user>-<host>
+
+    Switch to the configuration of a branch before merging it
+        no home --rev <branch>`)
 	}
 	flagSet.Parse(args)
 
-	err = os.Chdir(dir)
-
-	logger.Info("Rebuilding Home Manager for " + profile + "...")
-
-	cmd := exec.Command(
-		"home-manager",
-		operation,
-		"--flake",
-		".#"+profile)
+	flakeRef := "."
+	if rev != "" {
+		if flakeRef, err = flakeAtRev(ctx, rev); err != nil {
+			return err
+		}
+	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
+	locks := []LockRequest{}
+	flake, err := flakeLock(true)
+	if err != nil {
+		return err
+	}
+	locks = append(locks, flake)
+	if operation == "switch" {
+		locks = append(locks, LockRequest{Name: lockHome})
+	}
 
-	err = cmd.Run()
+	release, err := acquireLocks(ctx, locks...)
+	defer release()
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	return nil
+	err = os.Chdir(dir)
+
+	logger.Info("Rebuilding Home Manager for " + profile + "...")
+
+	return rebuildHome(ctx, profile, operation, flakeRef)
 }
 
-func rebuildCmd(args []string) error {
+func rebuildCmd(ctx context.Context, args []string) error {
 	var operation = "switch"
 	var operations = []Operation{
 		{
@@ -289,10 +384,24 @@ func rebuildCmd(args []string) error {
 		logger.Fatal(err)
 	}
 
+	var targetHost, buildHost, remoteEscalation, slot, rev string
+	var check, rollback, rebootIfNeeded, stage, label bool
+
 	flagSet := flag.NewFlagSet("rebuild", flag.ExitOnError)
 
 	flagSet.StringVar(&hostName, "config", hostName, "nixos configuration to use")
 	flagSet.StringVar(&hostName, "c", hostName, "nixos configuration to use")
+	flagSet.StringVar(&targetHost, "target-host", "", "activate on this host")
+	flagSet.StringVar(&buildHost, "build-host", "", "build on this host")
+	flagSet.StringVar(&remoteEscalation, "remote-escalation", "", "privilege escalation on the target host")
+	flagSet.DurationVar(&confirmTimeout, "confirm-timeout", confirmTimeout, "time to confirm the target host is reachable")
+	flagSet.BoolVar(&check, "check", false, "run health checks after activation")
+	flagSet.BoolVar(&rollback, "rollback", false, "roll back when health checks fail")
+	flagSet.BoolVar(&rebootIfNeeded, "reboot-if-needed", false, "reboot when the kernel or systemd changed")
+	flagSet.BoolVar(&stage, "stage", false, "build and stage for no activate")
+	flagSet.BoolVar(&label, "label", false, "label the generation with the git commit")
+	flagSet.StringVar(&rev, "rev", "", "build the flake as of this git revision")
+	flagSet.StringVar(&slot, "slot", "", "slot to stage in")
 
 	flagSet.Func("operation", "rebuild operation", func(flagValue string) error {
 		for _, op := range operations {
@@ -330,12 +439,55 @@ Usage:
 
 Flags:
 
+    --build-host  HOST
+        Build on HOST over ssh instead of on this machine.
+
+    --check  BOOL
+        Run the health checks of the config after switch and test.
+        (default 'true' when health checks are configured)
+
     -c, --config  STRING
         Specify which nixos configuration. (default 'hostname')
 
+    --confirm-timeout  DURATION
+        After switch or test on a target host, how long no has to reach it
+        again over a fresh ssh connection before it rolls back to the
+        previous generation. 0 disables the rollback. (default '30s')
+
+    --label  BOOL
+        Label the generation with the branch, short commit and dirty state
+        of the flake, shown in the boot menu. Evaluates the flake with
+        --impure so that it can read NIXOS_LABEL. (default 'false')
+
     -o, --operation  STRING
         Specify which operation to run. (default 'switch')
 
+    --reboot-if-needed  BOOL
+        Reboot the target when the new system changes its kernel, initrd,
+        kernel modules or systemd, which only take effect after a reboot.
+
+    --remote-escalation  STRING
+        Privilege escalation tool on the target host: auto, sudo, doas, run0
+        or none. auto is none when logging in as root, sudo otherwise.
+        (default 'auto')
+
+    --rev  COMMIT|BRANCH|TAG
+        Build the configuration as it was at this git revision of the flake,
+        leaving the working tree alone.
+
+    --rollback  BOOL
+        Roll back to the previous generation when a health check fails.
+
+    --slot  STRING
+        Name to stage the configuration as. (default the config name)
+
+    --stage  BOOL
+        Build the configuration and keep it as a GC root until no activate
+        activates it, instead of activating it now.
+
+    --target-host  USER@HOST
+        Copy the configuration to HOST over ssh and activate it there.
+
     -h, --help
         Print this help.
 
@@ -345,33 +497,119 @@ Examples:
         no rebuild -o boot
 
     Rebuild a specific configuration and dry-activate it
-        no rebuild -c <configName> -o dry-activate`)
+        no rebuild -c <configName> -o dry-activate
+
+    Build a configuration here and switch a remote machine to it
+        no rebuild -c <configName> --target-host root@<host>
+
+    Build the configuration now and switch to it later
+        no rebuild --stage && no activate
+
+    Boot into the system as it was at a tag
+        no rebuild -o boot --rev <tag>`)
 	}
 	flagSet.Parse(args)
 
-	err = os.Chdir(dir)
-	logger.Info("Rebuilding NixOS for " + hostName + "...")
+	flakeRef := "."
+	if rev != "" {
+		if flakeRef, err = flakeAtRev(ctx, rev); err != nil {
+			return err
+		}
+	}
 
-	cmd := exec.Command(
-		"sudo",
-		"nixos-rebuild",
-		operation,
-		"--flake",
-		".#"+hostName)
+	if stage {
+		if targetHost != "" {
+			return fmt.Errorf("--stage cannot be combined with --target-host")
+		}
+		if slot == "" {
+			slot = hostName
+		}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
+		flake, err := flakeLock(true)
+		if err != nil {
+			return err
+		}
+
+		release, err := acquireLocks(ctx, flake)
+		defer release()
+		if err != nil {
+			return err
+		}
+
+		err = os.Chdir(dir)
+		logger.Info("Staging NixOS for " + hostName + " as " + slot + "...")
 
-	err = cmd.Run()
+		return stageSystem(ctx, hostName, slot, rev, RebuildOptions{
+			BuildHost: buildHost,
+			Label:     label,
+			FlakeRef:  flakeRef,
+		})
+	}
+
+	// Health checks run by default once some are configured.
+	if !flagPassed(flagSet, "check") {
+		check = len(config.HealthChecks) > 0 || len(config.Hosts[hostName].HealthChecks) > 0
+	}
+
+	buildOnly := slices.Contains([]string{"build", "build-vm", "build-vm-with-bootloader"}, operation)
+
+	target := localTarget()
+	if targetHost != "" {
+		target = remoteTarget(targetHost, remoteEscalation)
+	}
+
+	locks := []LockRequest{}
+	flake, err := flakeLock(true)
 	if err != nil {
-		logger.Fatal(err)
+		return err
+	}
+	locks = append(locks, flake)
+	if !buildOnly && target.Local() {
+		locks = append(locks, LockRequest{Name: lockSystem})
+	} else if !buildOnly {
+		locks = append(locks, hostLock(target.Host))
 	}
 
-	return nil
+	release, err := acquireLocks(ctx, locks...)
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	if !buildOnly && target.Local() {
+		stopKeepalive, err := escalator.Keepalive(ctx)
+		defer stopKeepalive()
+		if err != nil {
+			return err
+		}
+	} else if !buildOnly {
+		if err := target.Validate(ctx); err != nil {
+			return err
+		}
+	}
+
+	err = os.Chdir(dir)
+	if target.Local() {
+		logger.Info("Rebuilding NixOS for " + hostName + "...")
+	} else {
+		logger.Info("Rebuilding NixOS for " + hostName + " on " + target.Host + "...")
+	}
+
+	return rebuildSystem(ctx, hostName, operation, RebuildOptions{
+		Target:         target,
+		BuildHost:      buildHost,
+		Check:          check,
+		Rollback:       rollback,
+		RebootIfNeeded: rebootIfNeeded,
+		Label:          label,
+		FlakeRef:       flakeRef,
+	})
 }
 
-func updateCmd(args []string) error {
+func updateCmd(ctx context.Context, args []string) error {
 	var rebuildBool bool
+	var asRootBool bool
+	var labelBool bool
 
 	hostName, err := os.Hostname()
 	if err != nil {
@@ -382,6 +620,8 @@ func updateCmd(args []string) error {
 
 	flagSet.BoolVar(&rebuildBool, "rebuild", false, "rebuild after update")
 	flagSet.BoolVar(&rebuildBool, "r", false, "rebuild after update")
+	flagSet.BoolVar(&asRootBool, "as-root", false, "update a root-owned flake as root")
+	flagSet.BoolVar(&labelBool, "label", false, "label the generation with the git commit")
 
 	flagSet.Usage = func() {
 		logger.Print(`Update a 'flake.lock' file.
@@ -395,6 +635,15 @@ Flags:
     -r, --rebuild  BOOL
         Rebuild system config and activate on boot. (default 'false')
 
+    --as-root  BOOL
+        Run 'nix flake update' as root, for a flake owned by root such as
+        /etc/nixos. (default 'false')
+
+    --label  BOOL
+        With --rebuild, label the generation with the branch, short commit
+        and dirty state of the flake, as 'no rebuild --label' does.
+        (default 'false')
+
     -h, --help
         Print this help.
 
@@ -410,54 +659,81 @@ Examples:
         no update nixpkgs
 
     Update multiple inputs
-        no update nixpkgs nixpkgs-unstable`)
+        no update nixpkgs nixpkgs-unstable
+
+    Update the root-owned flake in /etc/nixos
+        no -d /etc/nixos update --as-root`)
 	}
 	flagSet.Parse(args)
 
-	var inputs = strings.Join(flagSet.Args()[0:], " ")
+	locks := []LockRequest{}
+	flake, err := flakeLock(false)
+	if err != nil {
+		return err
+	}
+	locks = append(locks, flake)
+	if rebuildBool == true {
+		locks = append(locks, LockRequest{Name: lockSystem})
+	}
 
-	err = os.Chdir(dir)
-	logger.Infof("Updating flake in %s ...\n", dir)
+	release, err := acquireLocks(ctx, locks...)
+	defer release()
+	if err != nil {
+		return err
+	}
 
-	updateCmd := exec.Command(
-		"sudo",
-		"nix",
-		"flake",
-		"update")
-	if inputs != "" {
-		updateCmd = exec.Command(
-			"sudo",
-			"nix",
-			"flake",
-			"update",
-			inputs)
+	if rebuildBool == true || asRootBool == true {
+		stopKeepalive, err := escalator.Keepalive(ctx)
+		defer stopKeepalive()
+		if err != nil {
+			return err
+		}
 	}
 
-	updateCmd.Stdout = os.Stdout
-	updateCmd.Stderr = os.Stdout
+	err = os.Chdir(dir)
+	if err != nil {
+		return err
+	}
 
-	err = updateCmd.Run()
+	flakeDir, err := os.Getwd()
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	if rebuildBool == true {
-		logger.Info("Rebuilding NixOS...")
+	if err = repairOwnership(ctx, flakeDir, asRootBool); err != nil {
+		return err
+	}
 
-		rebuildCmd := exec.Command(
-			"sudo",
-			"nixos-rebuild",
-			"boot",
-			"--flake",
-			".#"+hostName)
+	logger.Infof("Updating flake in %s ...\n", dir)
 
-		rebuildCmd.Stdout = os.Stdout
-		rebuildCmd.Stderr = os.Stdout
+	err = runPhase(ctx, phaseUpdate, func(ctx context.Context) error {
+		updateArgs := append([]string{"flake", "update"}, flagSet.Args()...)
 
-		err = rebuildCmd.Run()
-		if err != nil {
-			logger.Fatal(err)
+		updateCmd := command(ctx, "nix", updateArgs...)
+		if asRootBool == true {
+			updateCmd = escalator.Command(ctx, "nix", updateArgs...)
 		}
+
+		updateCmd.Stdout = stdout
+		updateCmd.Stderr = stderr
+
+		if err := updateCmd.Run(); err != nil {
+			return fmt.Errorf("nix flake update: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if rebuildBool == true {
+		// The update rewrote flake.lock, which the label and the recorded
+		// generation have to show.
+		reportFlakeGitInfo(ctx)
+
+		logger.Info("Rebuilding NixOS...")
+
+		return rebuildSystem(ctx, hostName, "boot", RebuildOptions{Target: localTarget(), Label: labelBool})
 	}
 
 	return nil
@@ -466,10 +742,51 @@ Examples:
 func main() {
 	flag.StringVar(&dir, "directory", ".", "run in this dir")
 	flag.StringVar(&dir, "d", ".", "run in this dir")
+	flag.StringVar(&escalation, "escalation", "", "privilege escalation tool")
+	flag.StringVar(&escalation, "e", "", "privilege escalation tool")
+	flag.Func("timeout", "phase timeout", parseTimeoutFlag)
+	flag.Func("t", "phase timeout", parseTimeoutFlag)
+	flag.DurationVar(&lockWait, "wait", 0, "wait for other runs")
+	flag.DurationVar(&lockWait, "w", 0, "wait for other runs")
+	flag.BoolVar(&quiet, "quiet", false, "only show output on failure")
+	flag.BoolVar(&quiet, "q", false, "only show output on failure")
+	flag.BoolVar(&rawOutput, "raw", false, "show raw nix output")
+	flag.Func("output", "output format", parseOutputFormat)
+	flag.StringVar(&logLevel, "log-level", "", "log level")
+	flag.StringVar(&logFormat, "log-format", "", "log format")
+	flag.BoolVar(&logTimestamps, "log-timestamps", false, "show timestamps")
+	flag.StringVar(&colorMode, "color", "", "color mode")
 
 	flag.Usage = usage
 	flag.Parse()
 
+	if err = loadConfig(); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err = configureLogger(); err != nil {
+		logger.Fatal(err)
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if outputFormat == "json" {
+		stdout = os.Stderr
+	}
+
+	if escalation == "" {
+		escalation = config.Escalation
+	}
+
+	confirmTimeout = defaultConfirmTimeout
+	if config.ConfirmTimeout != nil {
+		confirmTimeout = config.ConfirmTimeout.Duration
+	}
+	escalator = newEscalator(escalation)
+
 	if len(flag.Args()) < 1 {
 		flag.Usage()
 		os.Exit(1)
@@ -478,7 +795,10 @@ func main() {
 	subCmd := flag.Arg(0)
 	subCmdArgs := flag.Args()[1:]
 
-	runCommand(subCmd, subCmdArgs)
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	runCommand(ctx, subCmd, subCmdArgs)
 }
 
 func usage() {
@@ -491,15 +811,52 @@ Usage:
 
 	logger.Print("\nCommands:\n")
 	for _, cmd := range commands {
-		logger.Printf("    %-8s %s\n", cmd.Name, cmd.Help)
+		logger.Printf("    %-11s %s\n", cmd.Name, cmd.Help)
 	}
 
 	logger.Print(`
 Flags:
 
+    --color  STRING
+        Color output: auto, always or never. auto honors NO_COLOR.
+        (default 'auto')
+
     -d, --directory  PATH
         Run in this directory, must be full path. (default '.')
 
+    -e, --escalation  STRING
+        Privilege escalation tool: auto, sudo, doas, run0 or none. (default 'auto')
+
+    --log-format  STRING
+        Log format: text, logfmt or json. (default 'text')
+
+    --log-level  STRING
+        Log level: debug, info, warn or error. debug also shows every
+        command run and its environment. (default 'info')
+
+    --log-timestamps  BOOL
+        Prefix log messages with a timestamp.
+
+    --output  STRING
+        Output format: text, or json to print a JSON report of the run on
+        stdout while all other output goes to stderr. (default 'text')
+
+    -q, --quiet  BOOL
+        Hide nix output behind a status line, showing it only on failure.
+
+    --raw  BOOL
+        Show raw nix output instead of the progress view.
+
+    -t, --timeout  PHASE=DURATION
+        Limit how long a phase may take, e.g. 'build=2h'. Phases are update,
+        build, copy, activation, check and gc. Can be repeated. (default
+        unbounded when run from a terminal, otherwise update=15m, build=3h,
+        copy=1h, activation=15m, check=10m, gc=2h)
+
+    -w, --wait  DURATION
+        Wait up to DURATION for another running no to finish instead of
+        failing immediately. (default '0s')
+
     -h, --help
         Print this help.
 
@@ -511,7 +868,7 @@ Examples:
 	logger.Print("\nRun `no <command> -h` to get help for a specific command")
 }
 
-func runCommand(name string, args []string) {
+func runCommand(ctx context.Context, name string, args []string) {
 	cmdIdx := slices.IndexFunc(commands, func(cmd Command) bool {
 		return cmd.Name == name
 	})
@@ -522,8 +879,87 @@ func runCommand(name string, args []string) {
 		os.Exit(1)
 	}
 
-	if err := commands[cmdIdx].Run(args); err != nil {
+	cmd := commands[cmdIdx]
+
+	report.Command = cmd.Name
+	report.Args = args
+	report.Flake = dir
+	report.Start = time.Now()
+
+	if cmd.Log {
+		reportFlakeGitInfo(ctx)
+	}
+
+	var finishQuiet func(error)
+	if quiet && cmd.Log {
+		finishQuiet = startQuiet(cmd.Name)
+	}
+
+	var runLog *RunLog
+	if cmd.Log {
+		var err error
+		runLog, err = openRunLog(cmd.Name, args)
+		if err != nil {
+			logger.Warn("could not open run log", "err", err)
+		}
+	}
+
+	output := &Capture{limit: diagnosticsLimit}
+	restoreOutput := teeOutput(output)
+
+	err := cmd.Run(ctx, args)
+	removeTempOutLinks()
+	restoreOutput()
+	if runLog != nil {
+		runLog.Close(err)
+	}
+	if finishQuiet != nil {
+		finishQuiet(err)
+	}
+
+	if runLog != nil {
+		report.Log = runLog.Path
+	}
+
+	exitCode := 0
+	var diagnoses []Diagnosis
+
+	if err != nil {
+		exitCode = 1
+
+		var timeoutErr *TimeoutError
+		if interrupt := interrupted(ctx); interrupt != nil {
+			err = interrupt
+			exitCode = exitInterrupted
+		} else if errors.As(err, &timeoutErr) {
+			err = timeoutErr
+			exitCode = exitTimeout
+		}
+
+		if cmd.Log {
+			diagnoses = diagnose(output.String())
+		}
+
 		logger.Errorf("Error: %s", err.Error())
-		os.Exit(1)
+		printDiagnoses(diagnoses)
+		if runLog != nil {
+			logger.Info("Full output was written to " + runLog.Path)
+		}
+	}
+
+	if cmd.Log {
+		report.Finish(err, exitCode, diagnoses)
+
+		if err := appendHistory(report); err != nil {
+			logger.Warn("could not record run in history", "err", err)
+		}
+
+		if outputFormat == "json" {
+			report.Print()
+		}
+	}
+
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 }
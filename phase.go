@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type Phase string
+
+const (
+	phaseUpdate     Phase = "update"
+	phaseBuild      Phase = "build"
+	phaseCopy       Phase = "copy"
+	phaseActivation Phase = "activation"
+	phaseCheck      Phase = "check"
+	phaseGC         Phase = "gc"
+)
+
+var phases = []Phase{phaseUpdate, phaseBuild, phaseCopy, phaseActivation, phaseCheck, phaseGC}
+
+// Exit code for runs where a phase timed out, as used by timeout(1).
+const exitTimeout = 124
+
+// Timeouts used when no is not attached to a terminal, so unattended runs
+// cannot hang forever. Interactive runs are unbounded unless configured.
+var nonInteractiveTimeouts = map[Phase]time.Duration{
+	phaseUpdate:     15 * time.Minute,
+	phaseBuild:      3 * time.Hour,
+	phaseCopy:       time.Hour,
+	phaseActivation: 15 * time.Minute,
+	phaseCheck:      10 * time.Minute,
+	phaseGC:         2 * time.Hour,
+}
+
+// Timeouts set with --timeout, taking precedence over the config.
+var timeoutFlags = map[Phase]time.Duration{}
+
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+type TimeoutError struct {
+	Phase   Phase
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s phase timed out after %s", e.Phase, e.Timeout)
+}
+
+func parsePhase(name string) (Phase, error) {
+	for _, phase := range phases {
+		if string(phase) == name {
+			return phase, nil
+		}
+	}
+
+	var names []string
+	for _, phase := range phases {
+		names = append(names, string(phase))
+	}
+	return "", fmt.Errorf("phase must be one of: %s", strings.Join(names, ", "))
+}
+
+func parseTimeoutFlag(flagValue string) error {
+	name, value, ok := strings.Cut(flagValue, "=")
+	if !ok {
+		return errors.New("timeout must be in the form PHASE=DURATION")
+	}
+
+	phase, err := parsePhase(name)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	timeoutFlags[phase] = timeout
+	return nil
+}
+
+// phaseTimeout returns how long phase may take, zero meaning unbounded.
+func phaseTimeout(phase Phase) time.Duration {
+	if timeout, ok := timeoutFlags[phase]; ok {
+		return timeout
+	}
+
+	if timeout, ok := config.Timeouts[string(phase)]; ok {
+		return timeout.Duration
+	}
+
+	if !isTerminal(os.Stdin) {
+		return nonInteractiveTimeouts[phase]
+	}
+
+	return 0
+}
+
+// runPhase runs fn bounded by the timeout of phase. Every child started from
+// the context handed to fn is stopped when the timeout expires, and the
+// returned error is a *TimeoutError naming the phase.
+func runPhase(ctx context.Context, phase Phase, fn func(ctx context.Context) error) (err error) {
+	status.Set(string(phase))
+
+	start := time.Now()
+	defer func() {
+		phaseReport := PhaseReport{Phase: phase, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			phaseReport.Error = err.Error()
+		}
+		report.Phases = append(report.Phases, phaseReport)
+	}()
+
+	timeout := phaseTimeout(phase)
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	phaseCtx, cancel := context.WithTimeoutCause(ctx, timeout, &TimeoutError{Phase: phase, Timeout: timeout})
+	defer cancel()
+
+	err = fn(phaseCtx)
+
+	var timeoutErr *TimeoutError
+	if err != nil && errors.As(context.Cause(phaseCtx), &timeoutErr) {
+		return timeoutErr
+	}
+
+	return err
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Show raw nix output even on a terminal.
+var rawOutput bool
+
+// Activity and result types of nix's internal-json log format, see
+// src/libutil/logging.hh in nix.
+const (
+	actCopyPath     = 100
+	actFileTransfer = 101
+	actCopyPaths    = 103
+	actBuilds       = 104
+	actBuild        = 105
+
+	resBuildLogLine = 101
+	resSetPhase     = 104
+	resProgress     = 105
+	resSetExpected  = 106
+)
+
+// Messages up to this nix verbosity are kept in the transcript; errors and
+// warnings are shown on the terminal as well.
+const (
+	nixLvlWarn = 1
+	nixLvlInfo = 3
+)
+
+const progressInterval = 100 * time.Millisecond
+
+// Running builds listed below the summary line.
+const progressMaxBuilds = 5
+
+type nixEvent struct {
+	Action string            `json:"action"`
+	ID     int64             `json:"id"`
+	Level  int               `json:"level"`
+	Type   int               `json:"type"`
+	Text   string            `json:"text"`
+	Msg    string            `json:"msg"`
+	Fields []json.RawMessage `json:"fields"`
+}
+
+func (e nixEvent) intField(i int) int64 {
+	var value int64
+	if i < len(e.Fields) {
+		json.Unmarshal(e.Fields[i], &value)
+	}
+	return value
+}
+
+func (e nixEvent) stringField(i int) string {
+	var value string
+	if i < len(e.Fields) {
+		json.Unmarshal(e.Fields[i], &value)
+	}
+	return value
+}
+
+type activity struct {
+	typ      int
+	name     string
+	phase    string
+	done     int64
+	expected int64
+	running  int64
+	failed   int64
+	start    time.Time
+	// Totals announced for child activities by type.
+	expectedByType map[int]int64
+}
+
+type activityTotals struct {
+	done     int64
+	expected int64
+	failed   int64
+}
+
+// Progress parses the internal-json log stream nix writes to stderr and
+// renders a compact live view of it, much like nix-output-monitor. Build
+// logs and messages are kept in the transcript. In quiet mode the summary is
+// shown in the status line instead.
+type Progress struct {
+	mu         sync.Mutex
+	pending    []byte
+	activities map[int64]*activity
+	totals     map[int]*activityTotals
+	start      time.Time
+	drawn      int
+	done       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+// progressEnabled reports whether nix should be asked for internal-json logs.
+func progressEnabled() bool {
+	return !rawOutput && (status != nil || (!quiet && isTerminal(os.Stdout) && isTerminal(os.Stderr)))
+}
+
+// nixLogArgs are the arguments making nix log in internal-json when the
+// progress view is used.
+func nixLogArgs() []string {
+	if !progressEnabled() {
+		return nil
+	}
+	return []string{"--log-format", "internal-json", "-v"}
+}
+
+// newProgress returns the stderr writer for a nix child: a live view when
+// progressEnabled, stderr otherwise. The returned function must be called once
+// the child exited.
+func newProgress() (io.Writer, func()) {
+	if !progressEnabled() {
+		return stderr, func() {}
+	}
+
+	p := &Progress{
+		activities: map[int64]*activity{},
+		totals:     map[int]*activityTotals{},
+		start:      time.Now(),
+		done:       make(chan struct{}),
+	}
+
+	p.stopped.Add(1)
+	go p.run()
+
+	return p, p.Close
+}
+
+func (p *Progress) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = append(p.pending, data...)
+	for {
+		idx := bytes.IndexByte(p.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		p.handleLine(string(p.pending[:idx]))
+		p.pending = p.pending[idx+1:]
+	}
+
+	return len(data), nil
+}
+
+func (p *Progress) Close() {
+	close(p.done)
+	p.stopped.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pending) > 0 {
+		p.handleLine(string(p.pending))
+		p.pending = nil
+	}
+	p.clear()
+
+	if status == nil {
+		if summary := p.summary(); summary != "" {
+			logger.Info(summary)
+		}
+	}
+}
+
+func (p *Progress) handleLine(line string) {
+	payload, ok := strings.CutPrefix(line, "@nix ")
+	if !ok {
+		p.print(line)
+		return
+	}
+
+	var event nixEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		p.print(line)
+		return
+	}
+
+	switch event.Action {
+	case "msg":
+		if event.Level <= nixLvlWarn {
+			p.print(event.Msg)
+		} else if event.Level <= nixLvlInfo {
+			fmt.Fprintln(transcript, event.Msg)
+		}
+	case "start":
+		act := &activity{typ: event.Type, start: time.Now(), expectedByType: map[int]int64{}}
+		if event.Type == actBuild {
+			act.name = derivationName(event.stringField(0))
+		}
+		p.activities[event.ID] = act
+		if event.Text != "" && event.Level <= nixLvlInfo {
+			fmt.Fprintln(transcript, event.Text)
+		}
+	case "stop":
+		act, ok := p.activities[event.ID]
+		if !ok {
+			return
+		}
+		totals := p.totalsFor(act.typ)
+		totals.done += act.done
+		totals.failed += act.failed
+		for typ, expected := range act.expectedByType {
+			p.totalsFor(typ).expected -= expected
+		}
+		delete(p.activities, event.ID)
+	case "result":
+		act, ok := p.activities[event.ID]
+		if !ok {
+			return
+		}
+		switch event.Type {
+		case resBuildLogLine:
+			fmt.Fprintln(transcript, act.name+"> "+event.stringField(0))
+		case resSetPhase:
+			act.phase = event.stringField(0)
+		case resProgress:
+			act.done = event.intField(0)
+			act.expected = event.intField(1)
+			act.running = event.intField(2)
+			act.failed = event.intField(3)
+		case resSetExpected:
+			typ := int(event.intField(0))
+			expected := event.intField(1)
+			totals := p.totalsFor(typ)
+			totals.expected += expected - act.expectedByType[typ]
+			act.expectedByType[typ] = expected
+		}
+	}
+}
+
+// print shows a line above the live view, or keeps it for the failure
+// report in quiet mode, and adds it to the transcript.
+func (p *Progress) print(line string) {
+	if status != nil {
+		fmt.Fprintln(stderr, line)
+		return
+	}
+
+	p.clear()
+	fmt.Fprintln(os.Stderr, line)
+	fmt.Fprintln(transcript, line)
+}
+
+func (p *Progress) totalsFor(typ int) *activityTotals {
+	totals, ok := p.totals[typ]
+	if !ok {
+		totals = &activityTotals{}
+		p.totals[typ] = totals
+	}
+	return totals
+}
+
+// stats sums up all activities of typ the same way nix's own progress bar
+// does.
+func (p *Progress) stats(typ int) (done, expected, running, failed int64) {
+	totals := p.totalsFor(typ)
+	done = totals.done
+	failed = totals.failed
+	expected = totals.done
+
+	for _, act := range p.activities {
+		if act.typ != typ {
+			continue
+		}
+		done += act.done
+		expected += act.expected
+		running += act.running
+		failed += act.failed
+	}
+
+	return done, max(expected, totals.expected), running, failed
+}
+
+func (p *Progress) summary() string {
+	var parts []string
+
+	if done, expected, _, failed := p.stats(actBuilds); expected > 0 {
+		part := fmt.Sprintf("built %d/%d", done, expected)
+		if failed > 0 {
+			part += fmt.Sprintf(" (%d failed)", failed)
+		}
+		parts = append(parts, part)
+	}
+
+	if done, expected, _, _ := p.stats(actCopyPaths); expected > 0 {
+		parts = append(parts, fmt.Sprintf("copied %d/%d", done, expected))
+	}
+
+	bytesDone, bytesExpected, _, _ := p.stats(actCopyPath)
+	transferDone, transferExpected, _, _ := p.stats(actFileTransfer)
+	bytesDone += transferDone
+	bytesExpected += transferExpected
+	if bytesExpected > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f/%.1f MiB", mebibytes(bytesDone), mebibytes(bytesExpected)))
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+func (p *Progress) runningBuilds() []*activity {
+	var builds []*activity
+	for _, act := range p.activities {
+		if act.typ == actBuild {
+			builds = append(builds, act)
+		}
+	}
+
+	slices.SortFunc(builds, func(a, b *activity) int {
+		return a.start.Compare(b.start)
+	})
+
+	return builds
+}
+
+func (p *Progress) run() {
+	defer p.stopped.Done()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for frame := 0; ; frame++ {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		if status != nil {
+			status.Set(string(phaseBuild) + ": " + p.summary())
+		} else {
+			p.render(frame)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Progress) render(frame int) {
+	summary := p.summary()
+	if summary == "" {
+		summary = "evaluating"
+	}
+
+	lines := []string{fmt.Sprintf("%s %s %s",
+		spinnerStyle.Render(spinnerFrames[frame%len(spinnerFrames)]),
+		summary,
+		faintStyle.Render(time.Since(p.start).Round(time.Second).String()))}
+
+	builds := p.runningBuilds()
+	for i, build := range builds {
+		if i == progressMaxBuilds {
+			lines = append(lines, faintStyle.Render(fmt.Sprintf("  … and %d more", len(builds)-i)))
+			break
+		}
+
+		line := "  building " + build.name
+		if build.phase != "" {
+			line += faintStyle.Render(" (" + build.phase + ")")
+		}
+		lines = append(lines, line)
+	}
+
+	p.clear()
+	fmt.Fprint(os.Stderr, strings.Join(lines, "\n"))
+	p.drawn = len(lines)
+}
+
+// clear erases the live view so that other output can be written.
+func (p *Progress) clear() {
+	if p.drawn == 0 {
+		return
+	}
+
+	if p.drawn > 1 {
+		fmt.Fprintf(os.Stderr, "\x1b[%dA", p.drawn-1)
+	}
+	fmt.Fprint(os.Stderr, "\r\x1b[J")
+	p.drawn = 0
+}
+
+// derivationName turns /nix/store/<hash>-hello-2.12.drv into hello-2.12.
+func derivationName(drvPath string) string {
+	name := strings.TrimSuffix(path.Base(drvPath), ".drv")
+	if _, rest, ok := strings.Cut(name, "-"); ok {
+		return rest
+	}
+	return name
+}
+
+func mebibytes(n int64) float64 {
+	return float64(n) / (1024 * 1024)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		name       string
+		stream     string
+		want       string
+		wantBuilds [4]int64
+		transcript string
+	}{
+		{
+			name: "build",
+			stream: `@nix {"action":"msg","level":3,"msg":"these 2 derivations will be built:"}
+@nix {"action":"msg","level":5,"msg":"evaluating file '/nix/store/xmqf6nfsfgcs5w0ndc0mrpq4k1x4f6b8-source/flake.nix'"}
+@nix {"action":"start","id":10,"level":0,"type":102,"text":"","fields":[],"parent":0}
+@nix {"action":"result","id":10,"type":106,"fields":[104,2]}
+@nix {"action":"start","id":11,"level":0,"type":104,"text":"","fields":[],"parent":10}
+@nix {"action":"result","id":11,"type":105,"fields":[0,2,0,0]}
+@nix {"action":"start","id":12,"level":3,"type":105,"text":"building '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-hello-2.12.drv'","fields":["/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-hello-2.12.drv","",1,1],"parent":11}
+@nix {"action":"result","id":11,"type":105,"fields":[0,2,1,0]}
+@nix {"action":"result","id":12,"type":104,"fields":["buildPhase"]}
+@nix {"action":"result","id":12,"type":101,"fields":["make all"]}
+@nix {"action":"stop","id":12}
+@nix {"action":"result","id":11,"type":105,"fields":[1,2,0,0]}
+@nix {"action":"start","id":13,"level":3,"type":105,"text":"building '/nix/store/dvmig3vf5kvfh4w0ycpqrh0gh0jyrqjm-nixos-system-laptop.drv'","fields":["/nix/store/dvmig3vf5kvfh4w0ycpqrh0gh0jyrqjm-nixos-system-laptop.drv","",1,1],"parent":11}
+@nix {"action":"stop","id":13}
+@nix {"action":"result","id":11,"type":105,"fields":[2,2,0,0]}
+@nix {"action":"stop","id":11}
+@nix {"action":"stop","id":10}`,
+			want:       "built 2/2",
+			wantBuilds: [4]int64{2, 2, 0, 0},
+			transcript: `these 2 derivations will be built:
+building '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-hello-2.12.drv'
+hello-2.12> make all
+building '/nix/store/dvmig3vf5kvfh4w0ycpqrh0gh0jyrqjm-nixos-system-laptop.drv'
+`,
+		},
+		{
+			name: "failed build",
+			stream: `@nix {"action":"start","id":10,"level":0,"type":102,"text":"","fields":[],"parent":0}
+@nix {"action":"result","id":10,"type":106,"fields":[104,2]}
+@nix {"action":"start","id":11,"level":0,"type":104,"text":"","fields":[],"parent":10}
+@nix {"action":"start","id":12,"level":3,"type":105,"text":"building '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-my-tool-1.0.drv'","fields":["/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-my-tool-1.0.drv","",1,1],"parent":11}
+@nix {"action":"result","id":12,"type":101,"fields":["make: *** [Makefile:12: all] Error 1"]}
+@nix {"action":"stop","id":12}
+@nix {"action":"result","id":11,"type":105,"fields":[0,2,0,1]}
+@nix {"action":"msg","level":0,"msg":"error: builder for '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-my-tool-1.0.drv' failed with exit code 2"}`,
+			want:       "built 0/2 (1 failed)",
+			wantBuilds: [4]int64{0, 2, 0, 1},
+			transcript: `building '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-my-tool-1.0.drv'
+my-tool-1.0> make: *** [Makefile:12: all] Error 1
+error: builder for '/nix/store/4kz3h0b6x1yqb2d5mzv5b9x5l8m2n5a7-my-tool-1.0.drv' failed with exit code 2
+`,
+		},
+		{
+			name: "copy in progress",
+			stream: `@nix {"action":"start","id":20,"level":0,"type":103,"text":"","fields":[],"parent":0}
+@nix {"action":"result","id":20,"type":105,"fields":[1,3,1,0]}
+@nix {"action":"start","id":21,"level":4,"type":100,"text":"copying path '/nix/store/8v8vlsq2xjd0qlb2kn4kxy5j3g6m4rxp-hello-2.12' to 'ssh-ng://web1'","fields":["/nix/store/8v8vlsq2xjd0qlb2kn4kxy5j3g6m4rxp-hello-2.12","","ssh-ng://web1"],"parent":20}
+@nix {"action":"result","id":21,"type":105,"fields":[1048576,2097152,0,0]}
+@nix {"action":"start","id":22,"level":4,"type":101,"text":"downloading 'https://cache.nixos.org/nar/0aa7vl6f10ljzk0h5y3rmz0dgg3k8w6c.nar.xz'","fields":["https://cache.nixos.org/nar/0aa7vl6f10ljzk0h5y3rmz0dgg3k8w6c.nar.xz"],"parent":0}
+@nix {"action":"result","id":22,"type":105,"fields":[524288,1048576,0,0]}`,
+			want: "copied 1/3 · 1.5/3.0 MiB",
+		},
+		{
+			name: "plain output",
+			stream: `warning: Git tree '/home/user/nixos' is dirty
+@nix {"action":"msg","level":1,"msg":"warning: ignoring untrusted substituter 'https://example.cachix.org'"}
+@nix {"action":"result","id":99,"type":101,"fields":["from an unknown activity"]}
+@nix {"action":"stop","id":99}
+@nix not json`,
+			transcript: `warning: Git tree '/home/user/nixos' is dirty
+warning: ignoring untrusted substituter 'https://example.cachix.org'
+@nix not json
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got bytes.Buffer
+			prevTranscript := transcript
+			transcript = &got
+			defer func() { transcript = prevTranscript }()
+
+			p := &Progress{
+				activities: map[int64]*activity{},
+				totals:     map[int]*activityTotals{},
+				start:      time.Now(),
+			}
+			for _, line := range strings.Split(test.stream, "\n") {
+				p.handleLine(line)
+			}
+
+			if summary := p.summary(); summary != test.want {
+				t.Errorf("summary() = %q, want %q", summary, test.want)
+			}
+			done, expected, running, failed := p.stats(actBuilds)
+			if builds := [4]int64{done, expected, running, failed}; builds != test.wantBuilds {
+				t.Errorf("stats(actBuilds) = %v, want %v", builds, test.wantBuilds)
+			}
+			if got.String() != test.transcript {
+				t.Errorf("transcript = %q, want %q", got.String(), test.transcript)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/log"
+)
+
+var quiet bool
+
+// Lines of captured output shown when a quiet run fails.
+const quietTailLines = 30
+
+const spinnerInterval = 100 * time.Millisecond
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+
+var stderrRenderer = lipgloss.NewRenderer(os.Stderr)
+
+var (
+	spinnerStyle = stderrRenderer.NewStyle().Foreground(lipgloss.Color("5"))
+	successStyle = stderrRenderer.NewStyle().Foreground(lipgloss.Color("2")).Bold(true)
+	failureStyle = stderrRenderer.NewStyle().Foreground(lipgloss.Color("1")).Bold(true)
+	faintStyle   = stderrRenderer.NewStyle().Faint(true)
+)
+
+// Capture collects child output, keeping only the last limit bytes when limit
+// is set.
+type Capture struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	limit int
+}
+
+func (c *Capture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, err := c.buf.Write(p)
+	if c.limit > 0 && c.buf.Len() > 2*c.limit {
+		c.buf.Next(c.buf.Len() - c.limit)
+	}
+
+	return n, err
+}
+
+func (c *Capture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ansiEscape.ReplaceAllString(c.buf.String(), "")
+}
+
+// Status is the single line shown on stderr while running quietly. Log
+// messages written through it clear the line first so they do not get mixed
+// up with the spinner.
+type Status struct {
+	mu      sync.Mutex
+	name    string
+	text    string
+	start   time.Time
+	shown   bool
+	paused  bool
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+var status *Status
+
+func (s *Status) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clear()
+	return os.Stderr.Write(p)
+}
+
+func (s *Status) clear() {
+	if s.shown {
+		io.WriteString(os.Stderr, "\r\x1b[K")
+		s.shown = false
+	}
+}
+
+func (s *Status) Set(text string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.text = text
+}
+
+// Pause hides the status line until Resume, e.g. while a password prompt is
+// shown.
+func (s *Status) Pause() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clear()
+	s.paused = true
+}
+
+func (s *Status) Resume() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = false
+}
+
+func (s *Status) run() {
+	defer s.stopped.Done()
+
+	ticker := time.NewTicker(spinnerInterval)
+	defer ticker.Stop()
+
+	for frame := 0; ; frame++ {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if !s.paused {
+			text := s.name
+			if s.text != "" {
+				text += ": " + s.text
+			}
+
+			s.clear()
+			fmt.Fprintf(os.Stderr, "%s %s %s",
+				spinnerStyle.Render(spinnerFrames[frame%len(spinnerFrames)]),
+				text,
+				faintStyle.Render(time.Since(s.start).Round(time.Second).String()))
+			s.shown = true
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Status) Stop() {
+	close(s.done)
+	s.stopped.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clear()
+}
+
+// startQuiet captures all child output instead of showing it and, on a
+// terminal, shows a status line with a spinner until the returned function
+// reports how the run ended.
+func startQuiet(name string) func(err error) {
+	capture := &Capture{}
+	stdout = capture
+	stderr = capture
+	transcript = capture
+
+	level := logger.GetLevel()
+	logger.SetLevel(log.WarnLevel)
+
+	start := time.Now()
+
+	if isTerminal(os.Stderr) {
+		status = &Status{name: name, start: start, done: make(chan struct{})}
+		logger.SetOutput(status)
+		logger.SetColorProfile(stderrRenderer.ColorProfile())
+
+		status.stopped.Add(1)
+		go status.run()
+	}
+
+	return func(err error) {
+		if status != nil {
+			status.Stop()
+			logger.SetOutput(os.Stderr)
+			status = nil
+		}
+		logger.SetLevel(level)
+
+		elapsed := time.Since(start).Round(time.Second)
+
+		if err == nil {
+			logger.Print(successStyle.Render("✓") + fmt.Sprintf(" %s finished in %s", name, elapsed))
+			return
+		}
+
+		output := capture.String()
+		lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+		if len(lines) > quietTailLines {
+			lines = lines[len(lines)-quietTailLines:]
+		}
+
+		logger.Print(failureStyle.Render("✗") + fmt.Sprintf(" %s failed after %s", name, elapsed))
+		if tail := strings.Join(lines, "\n"); strings.TrimSpace(tail) != "" {
+			logger.Print(faintStyle.Render(fmt.Sprintf("--- last %d lines of output ---", len(lines))))
+			logger.Print(tail)
+		}
+		if blocks := errorBlocks(output); len(blocks) > 0 {
+			logger.Print(faintStyle.Render("--- errors ---"))
+			for _, block := range blocks {
+				logger.Print(block)
+			}
+		}
+	}
+}
+
+// errorBlocks extracts nix error messages: a line starting with "error:" and
+// the indented lines following it.
+func errorBlocks(output string) []string {
+	var blocks []string
+	var block []string
+
+	flush := func() {
+		if len(block) > 0 {
+			blocks = append(blocks, strings.TrimRight(strings.Join(block, "\n"), "\n "))
+			block = nil
+		}
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.HasPrefix(line, "error:"):
+			flush()
+			block = append(block, line)
+		case len(block) > 0 && (line == "" || strings.HasPrefix(line, " ")):
+			block = append(block, line)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return blocks
+}
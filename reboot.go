@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Exit code of no status when the target needs a reboot.
+const exitRebootRequired = 3
+
+// Parts of a system that only take effect after a reboot.
+var bootComponents = []string{"kernel", "initrd", "kernel-modules", "systemd"}
+
+const (
+	bootedSystem  = "/run/booted-system"
+	currentSystem = "/run/current-system"
+)
+
+// rebootRequired returns the boot components that differ between the system
+// target booted and system, in one round trip to the target.
+func rebootRequired(ctx context.Context, target Target, system string) ([]string, error) {
+	args := []string{"-f"}
+	for _, component := range bootComponents {
+		args = append(args, bootedSystem+"/"+component, system+"/"+component)
+	}
+
+	out, err := target.Output(ctx, "readlink", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := strings.Split(out, "\n")
+	if len(paths) != 2*len(bootComponents) {
+		return nil, fmt.Errorf("unexpected readlink output on %s", target)
+	}
+
+	var changed []string
+	for i, component := range bootComponents {
+		if paths[2*i] != paths[2*i+1] {
+			changed = append(changed, component)
+		}
+	}
+	return changed, nil
+}
+
+// checkReboot tells whether target needs a reboot to fully run the system
+// operation activated, and reboots it when asked to.
+func checkReboot(ctx context.Context, target Target, path, operation string, reboot bool) error {
+	system := currentSystem
+	if operation == "boot" {
+		system = path
+	}
+
+	changed, err := rebootRequired(ctx, target, system)
+	if err != nil {
+		logger.Warn("could not check whether a reboot is required", "err", err)
+		return nil
+	}
+
+	report.RebootRequired = changed
+	if len(changed) == 0 {
+		return nil
+	}
+
+	logger.Warn("Reboot required", "host", target, "changed", strings.Join(changed, ", "))
+	if !reboot {
+		return nil
+	}
+
+	logger.Info("Rebooting " + target.String() + "...")
+
+	cmd := target.EscalatedCommand(ctx, "systemctl", "reboot")
+	cmd.Stdout, cmd.Stderr = target.outputs()
+
+	if err := cmd.Run(); err != nil && target.Local() {
+		return fmt.Errorf("systemctl reboot: %w", err)
+	}
+	// A remote host may drop the connection before systemctl returns.
+	return nil
+}
+
+type SystemStatus struct {
+	Host           string   `json:"host"`
+	Generation     int      `json:"generation,omitempty"`
+	CurrentSystem  string   `json:"current_system"`
+	BootedSystem   string   `json:"booted_system"`
+	RebootRequired []string `json:"reboot_required"`
+}
+
+func statusCmd(ctx context.Context, args []string) error {
+	var targetHost string
+
+	flagSet := flag.NewFlagSet("status", flag.ExitOnError)
+	flagSet.StringVar(&targetHost, "target-host", "", "check this host")
+	flagSet.Usage = func() {
+		logger.Print(`Show the running system and whether a reboot is required.
+
+Usage:
+
+    no status [flags]
+
+A reboot is required when the kernel, initrd, kernel modules or systemd of
+the running system differ from those it booted with. no status then exits
+with status 3, so scripts can act on it.
+
+Flags:
+
+    --target-host  USER@HOST
+        Check HOST over ssh instead of this machine.
+
+    -h, --help
+        Print this help.
+
+Examples:
+
+    Reboot only when needed
+        no status; [ $? -eq 3 ] && systemctl reboot`)
+	}
+	flagSet.Parse(args)
+
+	target := localTarget()
+	if targetHost != "" {
+		target = remoteTarget(targetHost, "")
+	}
+
+	current, err := target.Output(ctx, "readlink", "-f", currentSystem)
+	if err != nil {
+		return err
+	}
+
+	booted, err := target.Output(ctx, "readlink", "-f", bootedSystem)
+	if err != nil {
+		return err
+	}
+
+	changed, err := rebootRequired(ctx, target, currentSystem)
+	if err != nil {
+		return err
+	}
+
+	systemStatus := SystemStatus{
+		Host:           target.String(),
+		Generation:     target.Generation(ctx, systemProfile),
+		CurrentSystem:  current,
+		BootedSystem:   booted,
+		RebootRequired: changed,
+	}
+
+	if outputFormat == "json" {
+		if systemStatus.RebootRequired == nil {
+			systemStatus.RebootRequired = []string{}
+		}
+		json.NewEncoder(os.Stdout).Encode(systemStatus)
+	} else {
+		reboot := "not required"
+		if len(changed) > 0 {
+			reboot = "required, changed " + strings.Join(changed, ", ")
+		}
+
+		fmt.Fprintf(os.Stdout, "%-12s %s\n", "host:", systemStatus.Host)
+		if systemStatus.Generation > 0 {
+			fmt.Fprintf(os.Stdout, "%-12s %d\n", "generation:", systemStatus.Generation)
+		}
+		fmt.Fprintf(os.Stdout, "%-12s %s\n", "current:", systemStatus.CurrentSystem)
+		fmt.Fprintf(os.Stdout, "%-12s %s\n", "booted:", systemStatus.BootedSystem)
+		fmt.Fprintf(os.Stdout, "%-12s %s\n", "reboot:", reboot)
+	}
+
+	if len(changed) > 0 {
+		os.Exit(exitRebootRequired)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Target is the machine a configuration is activated on: this one, or a
+// remote host reached over ssh.
+type Target struct {
+	Host      string
+	Escalator Escalator
+	// Log receives the output of commands run for the target instead of
+	// stdout and stderr, and keeps them from asking for input.
+	Log io.Writer
+	// SSHOptions are passed to ssh after those in NIX_SSHOPTS.
+	SSHOptions []string
+}
+
+func localTarget() Target {
+	return Target{Escalator: escalator}
+}
+
+// remoteTarget returns a target for host, usually user@host. Escalation on
+// the remote side is skipped when logging in as root.
+func remoteTarget(host, escalation string) Target {
+	if escalation == "" {
+		escalation = config.RemoteEscalation
+	}
+
+	user, _, ok := strings.Cut(host, "@")
+	if escalation == "" || escalation == "auto" {
+		escalation = "sudo"
+		if ok && user == "root" {
+			escalation = "none"
+		}
+	}
+
+	target := Target{
+		Host:      host,
+		Escalator: Escalator{Name: escalation, Path: escalation, remote: true},
+	}
+	if escalation != "none" && !slices.Contains(escalators, escalation) {
+		target.Escalator.err = fmt.Errorf(
+			"remote escalation must be one of: auto, %s, none", strings.Join(escalators, ", "))
+	}
+	return target
+}
+
+func (t Target) Local() bool {
+	return t.Host == ""
+}
+
+// outputs returns where output of commands run for the target goes.
+func (t Target) outputs() (io.Writer, io.Writer) {
+	if t.Log != nil {
+		return t.Log, t.Log
+	}
+	return stdout, stderr
+}
+
+func (t Target) String() string {
+	if t.Local() {
+		return "localhost"
+	}
+	return t.Host
+}
+
+// StoreURI is how nix reaches the store of the target.
+func (t Target) StoreURI() string {
+	return "ssh-ng://" + t.Host
+}
+
+// Command runs name unprivileged on the target.
+func (t Target) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if t.Local() {
+		return command(ctx, name, args...)
+	}
+	return sshCommand(ctx, t.Host, t.SSHOptions, false, append([]string{name}, args...))
+}
+
+// EscalatedCommand runs name as root on the target.
+func (t Target) EscalatedCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if t.Local() {
+		return t.Escalator.Command(ctx, name, args...)
+	}
+	// Nobody can answer a password prompt in output that goes to Log, so
+	// escalation fails right away there instead of hanging.
+	e := t.Escalator
+	e.noPrompt = t.Log != nil
+	interactive := e.Name != "none" && t.Log == nil
+	return sshCommand(ctx, t.Host, t.SSHOptions, interactive, e.Args(name, args...))
+}
+
+// Output runs name unprivileged on the target and returns what it printed.
+func (t Target) Output(ctx context.Context, name string, args ...string) (string, error) {
+	var out bytes.Buffer
+
+	cmd := t.Command(ctx, name, args...)
+	cmd.Stdout = &out
+	_, cmd.Stderr = t.outputs()
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s on %s: %w", name, t, err)
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// Validate checks escalation on the target before anything is changed there.
+func (t Target) Validate(ctx context.Context) error {
+	if t.Local() {
+		return t.Escalator.Validate(ctx)
+	}
+	if t.Escalator.err != nil {
+		return t.Escalator.err
+	}
+	if t.Escalator.Name == "none" {
+		return nil
+	}
+
+	status.Pause()
+	defer status.Resume()
+
+	cmd := t.EscalatedCommand(ctx, "true")
+	cmd.Stdout, cmd.Stderr = t.outputs()
+
+	if err := cmd.Run(); err != nil {
+		return &EscalationError{Escalator: t.Escalator.Name + " on " + t.Host, Err: err}
+	}
+	return nil
+}
+
+// Generation returns the generation profile points to on the target.
+func (t Target) Generation(ctx context.Context, profile string) int {
+	if t.Local() {
+		return profileGeneration(profile)
+	}
+
+	link, err := t.Output(ctx, "readlink", profile)
+	if err != nil {
+		return 0
+	}
+	return linkGeneration(link)
+}
+
+// sshCommand runs argv on host. Interactive commands get a terminal so that
+// a remote sudo can ask for a password.
+func sshCommand(ctx context.Context, host string, options []string, interactive bool, argv []string) *exec.Cmd {
+	args := append(strings.Fields(os.Getenv("NIX_SSHOPTS")), options...)
+	if interactive && isTerminal(os.Stdin) {
+		args = append(args, "-t")
+	}
+	args = append(args, host, "--", shellJoin(argv))
+
+	cmd := command(ctx, "ssh", args...)
+	if interactive {
+		cmd.Stdin = os.Stdin
+	}
+	return cmd
+}
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9@%+=:,./_-]+$`)
+
+// shellJoin quotes argv for the remote shell ssh hands the command to.
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// copyClosure copies path and everything it depends on to target, from the
+// store of buildHost or the local one, letting the target fetch what it can
+// from its substituters.
+func copyClosure(ctx context.Context, target Target, path, buildHost string) error {
+	args := []string{"copy", "--substitute-on-destination"}
+	if buildHost != "" {
+		args = append(args, "--from", "ssh-ng://"+buildHost)
+	}
+	if !target.Local() {
+		args = append(args, "--to", target.StoreURI())
+	}
+	args = append(args, path)
+
+	if target.Log != nil {
+		cmd := command(ctx, "nix", args...)
+		cmd.Stdout, cmd.Stderr = target.outputs()
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("nix copy: %w", err)
+		}
+		return nil
+	}
+
+	cmd := command(ctx, "nix", append(args, nixLogArgs()...)...)
+
+	progress, finishProgress := newProgress()
+
+	cmd.Stdout = stdout
+	cmd.Stderr = progress
+
+	err := cmd.Run()
+	finishProgress()
+	if err != nil {
+		return fmt.Errorf("nix copy: %w", err)
+	}
+
+	return nil
+}
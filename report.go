@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Output format of the run: text for human logs only, or json for a single
+// JSON document on stdout describing the run.
+var outputFormat = "text"
+
+type PhaseReport struct {
+	Phase    Phase   `json:"phase"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Report describes what a run did. Commands fill it in as they go and it is
+// printed as JSON when the run ends with --output json.
+type Report struct {
+	Command          string        `json:"command"`
+	Args             []string      `json:"args"`
+	Flake            string        `json:"flake,omitempty"`
+	FlakeCommit      string        `json:"flake_commit,omitempty"`
+	FlakeBranch      string        `json:"flake_branch,omitempty"`
+	FlakeDirty       bool          `json:"flake_dirty,omitempty"`
+	Target           string        `json:"target,omitempty"`
+	TargetHost       string        `json:"target_host,omitempty"`
+	BuildHost        string        `json:"build_host,omitempty"`
+	Operation        string        `json:"operation,omitempty"`
+	GenerationBefore int           `json:"generation_before,omitempty"`
+	GenerationAfter  int           `json:"generation_after,omitempty"`
+	StorePaths       []string      `json:"store_paths,omitempty"`
+	Phases           []PhaseReport `json:"phases,omitempty"`
+	Units            *UnitChanges  `json:"units,omitempty"`
+	HealthChecks     []CheckResult `json:"health_checks,omitempty"`
+	RebootRequired   []string      `json:"reboot_required,omitempty"`
+	Hosts            []HostReport  `json:"hosts,omitempty"`
+	Start            time.Time     `json:"start"`
+	Duration         float64       `json:"duration_seconds"`
+	ExitStatus       int           `json:"exit_status"`
+	Error            string        `json:"error,omitempty"`
+	ErrorCategory    string        `json:"error_category,omitempty"`
+	Diagnoses        []Diagnosis   `json:"diagnoses,omitempty"`
+	Log              string        `json:"log,omitempty"`
+}
+
+var report = &Report{}
+
+func parseOutputFormat(flagValue string) error {
+	switch flagValue {
+	case "text", "json":
+		outputFormat = flagValue
+		return nil
+	}
+	return fmt.Errorf("output must be one of: text, json")
+}
+
+// errorCategory sorts err into a category scripts can act on. Failures nix
+// reported are categorized by their diagnosis.
+func errorCategory(err error, diagnoses []Diagnosis) string {
+	var (
+		interruptErr  *InterruptError
+		timeoutErr    *TimeoutError
+		lockedErr     *LockedError
+		escalationErr *EscalationError
+		rollbackErr   *RollbackError
+		healthErr     *HealthError
+	)
+
+	switch {
+	case errors.As(err, &interruptErr):
+		return "interrupted"
+	case errors.As(err, &timeoutErr):
+		return "timeout"
+	case errors.As(err, &lockedErr):
+		return "locked"
+	case errors.As(err, &escalationErr):
+		return "escalation"
+	case errors.As(err, &rollbackErr):
+		return "rolled-back"
+	case errors.As(err, &healthErr):
+		return "unhealthy"
+	case len(diagnoses) > 0:
+		return diagnoses[0].Category
+	}
+	return "command"
+}
+
+func (r *Report) Finish(err error, exitStatus int, diagnoses []Diagnosis) {
+	r.Duration = time.Since(r.Start).Seconds()
+	r.ExitStatus = exitStatus
+	r.Diagnoses = diagnoses
+	if err != nil {
+		r.Error = err.Error()
+		r.ErrorCategory = errorCategory(err, diagnoses)
+	}
+}
+
+func (r *Report) Print() {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(r)
+}
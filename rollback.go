@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a remote host has to be reachable again after activation before
+// it rolls itself back, zero disabling magic rollback.
+var confirmTimeout time.Duration
+
+const (
+	defaultConfirmTimeout = 30 * time.Second
+	confirmRetryInterval  = 2 * time.Second
+	// Time given to the rollback itself before checking that it happened.
+	rollbackGracePeriod = 30 * time.Second
+)
+
+// MagicRollback is a watchdog armed on a remote host when it is activated.
+// Unless no reaches the host again over a fresh ssh connection in time, the
+// host switches back to the system it was running before.
+type MagicRollback struct {
+	Target     Target
+	Operation  string
+	Timeout    time.Duration
+	Unit       string
+	Previous   string
+	Generation int
+}
+
+type RollbackError struct {
+	Host       string
+	Generation int
+	Fired      bool
+	Err        error
+}
+
+func (e *RollbackError) Error() string {
+	if e.Fired {
+		return fmt.Sprintf("%s was not reachable after activation (%s) and rolled back to generation %d", e.Host, e.Err, e.Generation)
+	}
+	return fmt.Sprintf("%s was not reachable after activation (%s) and should have rolled back to generation %d, but that could not be confirmed", e.Host, e.Err, e.Generation)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// previousSystem returns the system that operation replaces on target: the
+// running one, or for boot the one the system profile points to.
+func previousSystem(ctx context.Context, target Target, operation string) (string, error) {
+	if operation == "boot" {
+		return target.Output(ctx, "readlink", "-f", systemProfile)
+	}
+	return target.Output(ctx, "readlink", "-f", "/run/current-system")
+}
+
+// rollbackCommands returns the commands that undo operation: point the
+// system profile back at generation and activate previous again.
+func rollbackCommands(previous string, generation int, operation string) [][]string {
+	var argvs [][]string
+	if (operation == "switch" || operation == "boot") && generation > 0 {
+		argvs = append(argvs, []string{
+			"nix-env", "--profile", systemProfile, "--switch-generation", strconv.Itoa(generation),
+		})
+	}
+	return append(argvs, []string{previous + "/bin/switch-to-configuration", operation})
+}
+
+// rollbackSystem undoes operation on target right away.
+func rollbackSystem(ctx context.Context, target Target, previous string, generation int, operation string) error {
+	for _, argv := range rollbackCommands(previous, generation, operation) {
+		cmd := target.EscalatedCommand(ctx, argv[0], argv[1:]...)
+		cmd.Stdout, cmd.Stderr = target.outputs()
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("rolling back %s: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// prepareRollback records what target runs before it is activated. It
+// returns nil when magic rollback does not apply: local or disabled, or an
+// operation that leaves the running system alone.
+func prepareRollback(ctx context.Context, target Target, operation string) (*MagicRollback, error) {
+	if target.Local() || confirmTimeout <= 0 || (operation != "switch" && operation != "test") {
+		return nil, nil
+	}
+
+	previous, err := previousSystem(ctx, target, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MagicRollback{
+		Target:     target,
+		Operation:  operation,
+		Timeout:    confirmTimeout,
+		Unit:       "no-rollback-" + strconv.FormatInt(time.Now().Unix(), 10),
+		Previous:   previous,
+		Generation: target.Generation(ctx, systemProfile),
+	}, nil
+}
+
+// wrap turns the switch-to-configuration argv into one that runs in a
+// transient unit on the target, so that it finishes even when the ssh
+// connection drops, and then arms the rollback timer.
+func (m *MagicRollback) wrap(argv []string) []string {
+	var rollback []string
+	for _, rollbackArgv := range rollbackCommands(m.Previous, m.Generation, m.Operation) {
+		rollback = append(rollback, shellJoin(rollbackArgv))
+	}
+
+	script := strings.Join([]string{
+		shellJoin(argv),
+		"status=$?",
+		shellJoin([]string{
+			"systemd-run",
+			"--quiet",
+			"--collect",
+			"--unit=" + m.Unit,
+			"--description=no magic rollback",
+			"--on-active=" + strconv.Itoa(int(m.Timeout.Seconds())) + "s",
+			"--timer-property=AccuracySec=1s",
+			"/bin/sh", "-c", strings.Join(rollback, " && "),
+		}),
+		"exit $status",
+	}, "\n")
+
+	return transientUnit(m.activationUnit(), []string{"/bin/sh", "-c", script})
+}
+
+// activationUnit names the transient unit wrap runs the activation in.
+func (m *MagicRollback) activationUnit() string {
+	return strings.Replace(m.Unit, "rollback", "activate", 1)
+}
+
+// fresh returns the target reached over a new ssh connection, never one
+// shared with earlier commands, as the point is to prove a new login works.
+func (m *MagicRollback) fresh() Target {
+	target := m.Target
+	target.SSHOptions = append(slices.Clone(target.SSHOptions),
+		"-o", "ControlMaster=no",
+		"-o", "ControlPath=none",
+		"-o", "ConnectTimeout="+strconv.Itoa(int(confirmRetryInterval.Seconds()*5)))
+	return target
+}
+
+// Confirm disarms the rollback over a fresh ssh connection, retrying until
+// the timer is about to fire. When that fails, it waits for the rollback and
+// checks that the host is back on the previous system.
+func (m *MagicRollback) Confirm(ctx context.Context) error {
+	logger.Info("Confirming " + m.Target.Host + " is reachable...")
+
+	fresh := m.fresh()
+	deadline := time.Now().Add(m.Timeout * 4 / 5)
+
+	var err error
+	for {
+		cmd := fresh.EscalatedCommand(ctx, "systemctl", "stop", m.Unit+".timer")
+		cmd.Stdout, cmd.Stderr = fresh.outputs()
+
+		if err = cmd.Run(); err == nil {
+			logger.Info("Confirmed " + m.Target.Host + ", magic rollback disarmed")
+			return nil
+		}
+
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(confirmRetryInterval):
+		}
+	}
+
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	logger.Warn("could not reach host after activation, waiting for it to roll back",
+		"host", m.Target.Host, "generation", m.Generation)
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-time.After(time.Until(deadline) + m.Timeout/5 + rollbackGracePeriod):
+	}
+
+	rollbackErr := &RollbackError{Host: m.Target.Host, Generation: m.Generation, Err: err}
+
+	current, currentErr := fresh.Output(ctx, "readlink", "-f", "/run/current-system")
+	rollbackErr.Fired = currentErr == nil && current == m.Previous
+
+	return rollbackErr
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const nixStore = "/nix/store"
+
+// GCRoot is a store path that no keeps from garbage collection. It is linked
+// from a directory in the state directory, with a JSON file of the same name
+// next to the link describing where it came from.
+type GCRoot struct {
+	Name        string    `json:"name"`
+	StorePath   string    `json:"store_path"`
+	Created     time.Time `json:"created"`
+	Config      string    `json:"config,omitempty"`
+	Flake       string    `json:"flake,omitempty"`
+	FlakeCommit string    `json:"flake_commit,omitempty"`
+	FlakeBranch string    `json:"flake_branch,omitempty"`
+	FlakeDirty  bool      `json:"flake_dirty,omitempty"`
+	// Rev is the revision given to --rev, if the root was built from one.
+	Rev string `json:"rev,omitempty"`
+}
+
+var gcRootName = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
+
+// rootsDir returns the directory holding one kind of GC roots, e.g. staged.
+func rootsDir(kind string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "gcroots", kind), nil
+}
+
+// addRoot links root.StorePath from dir and registers the link with nix as
+// a GC root, replacing any root of the same name.
+func addRoot(ctx context.Context, dir string, root GCRoot) error {
+	if !gcRootName.MatchString(root.Name) {
+		return fmt.Errorf("invalid name %q: use letters, digits, '.', '_' and '-'", root.Name)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	link := filepath.Join(dir, root.Name)
+
+	cmd := command(ctx, "nix-store", "--add-root", link, "--realise", root.StorePath)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nix-store --add-root: %w", err)
+	}
+
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(link+".json", append(data, '\n'), 0o644)
+}
+
+// readRoot returns the root name in dir. The error wraps fs.ErrNotExist when
+// there is none.
+func readRoot(dir, name string) (GCRoot, error) {
+	if !gcRootName.MatchString(name) {
+		return GCRoot{}, fmt.Errorf("invalid name %q: %w", name, fs.ErrNotExist)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if err != nil {
+		return GCRoot{}, err
+	}
+
+	var root GCRoot
+	if err = json.Unmarshal(data, &root); err != nil {
+		return GCRoot{}, fmt.Errorf("parsing %s: %w", name+".json", err)
+	}
+
+	if _, err = os.Lstat(filepath.Join(dir, name)); errors.Is(err, fs.ErrNotExist) {
+		return GCRoot{}, fmt.Errorf("%s is no longer linked: %w", name, err)
+	}
+
+	return root, nil
+}
+
+// removeRoot deletes the root name from dir, leaving its store path to the
+// next garbage collection.
+func removeRoot(dir, name string) error {
+	if _, err := readRoot(dir, name); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, name+".json"))
+}
+
+// listRoots returns the roots in dir ordered by name.
+func listRoots(dir string) ([]GCRoot, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []GCRoot
+	for _, file := range files {
+		root, err := readRoot(dir, strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			logger.Warn("skipping unreadable GC root", "file", file, "err", err)
+			continue
+		}
+		roots = append(roots, root)
+	}
+
+	return roots, nil
+}
+
+// closureSizes returns the closure size in bytes of each of paths.
+func closureSizes(ctx context.Context, paths []string) (map[string]int64, error) {
+	var out bytes.Buffer
+
+	cmd := command(ctx, "nix", append([]string{"path-info", "--closure-size"}, paths...)...)
+	cmd.Stdout = &out
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("nix path-info: %w", err)
+	}
+
+	sizes := map[string]int64{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if size, err := strconv.ParseInt(fields[len(fields)-1], 10, 64); err == nil {
+			sizes[fields[0]] = size
+		}
+	}
+
+	return sizes, nil
+}
+
+// storePath returns the store path that path is or points into, e.g. the
+// result link of nix build.
+func storePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	rest, ok := strings.CutPrefix(resolved, nixStore+"/")
+	if !ok || rest == "" {
+		return "", fmt.Errorf("%s is not in %s", path, nixStore)
+	}
+
+	name, _, _ := strings.Cut(rest, "/")
+	return nixStore + "/" + name, nil
+}
+
+func formatSize(n int64) string {
+	if n >= 1024*1024*1024 {
+		return fmt.Sprintf("%.1f GiB", mebibytes(n)/1024)
+	}
+	return fmt.Sprintf("%.1f MiB", mebibytes(n))
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	case d >= time.Hour:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(d/time.Minute)) + "m"
+}
+
+func rootsCmd(ctx context.Context, args []string) error {
+	flagSet := flag.NewFlagSet("roots", flag.ExitOnError)
+	flagSet.Usage = func() {
+		logger.Print(`Keep store paths from garbage collection.
+
+Usage:
+
+    no roots [list]
+    no roots pin <name> <path>
+    no roots unpin <name>
+
+Pinned paths are linked from $XDG_STATE_HOME/no/gcroots/pinned and survive
+no garbage until they are unpinned. Systems staged by no rebuild --stage
+are listed as staged/<slot> and released the same way.
+
+Flags:
+
+    -h, --help
+        Print this help.
+
+Examples:
+
+    Keep a configuration built for another host
+        no rebuild -c <configName> -o build
+        no roots pin <configName>-next ./result`)
+	}
+	flagSet.Parse(args)
+
+	pinnedDir, err := rootsDir("pinned")
+	if err != nil {
+		return err
+	}
+
+	stagedDir, err := rootsDir("staged")
+	if err != nil {
+		return err
+	}
+
+	// Staged systems are addressed as staged/<slot>.
+	rootDir := func(name string) (string, string) {
+		if slot, ok := strings.CutPrefix(name, "staged/"); ok {
+			return stagedDir, slot
+		}
+		return pinnedDir, name
+	}
+
+	switch flagSet.Arg(0) {
+	case "pin":
+		if flagSet.NArg() != 3 {
+			return fmt.Errorf("usage: no roots pin <name> <path>")
+		}
+
+		path, err := storePath(flagSet.Arg(2))
+		if err != nil {
+			return err
+		}
+
+		err = addRoot(ctx, pinnedDir, GCRoot{Name: flagSet.Arg(1), StorePath: path, Created: time.Now()})
+		if err == nil {
+			logger.Info("Pinned " + path + " as " + flagSet.Arg(1))
+		}
+		return err
+	case "unpin":
+		if flagSet.NArg() != 2 {
+			return fmt.Errorf("usage: no roots unpin <name>")
+		}
+
+		dir, name := rootDir(flagSet.Arg(1))
+		err := removeRoot(dir, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("no root named %s", flagSet.Arg(1))
+		}
+		if err == nil {
+			logger.Info("Unpinned " + flagSet.Arg(1) + ", it is removed by the next garbage collection")
+		}
+		return err
+	case "", "list":
+	default:
+		return fmt.Errorf("unknown roots command %q", flagSet.Arg(0))
+	}
+
+	pinned, err := listRoots(pinnedDir)
+	if err != nil {
+		return err
+	}
+
+	staged, err := listRoots(stagedDir)
+	if err != nil {
+		return err
+	}
+	for i := range staged {
+		staged[i].Name = "staged/" + staged[i].Name
+	}
+
+	roots := append(pinned, staged...)
+
+	var paths []string
+	for _, root := range roots {
+		paths = append(paths, root.StorePath)
+	}
+
+	var sizes map[string]int64
+	if len(paths) > 0 {
+		if sizes, err = closureSizes(ctx, paths); err != nil {
+			logger.Warn("could not get closure sizes", "err", err)
+		}
+	}
+
+	if outputFormat == "json" {
+		type rootInfo struct {
+			GCRoot
+			ClosureSize int64 `json:"closure_size,omitempty"`
+		}
+
+		infos := []rootInfo{}
+		for _, root := range roots {
+			infos = append(infos, rootInfo{GCRoot: root, ClosureSize: sizes[root.StorePath]})
+		}
+		return json.NewEncoder(os.Stdout).Encode(infos)
+	}
+
+	for _, root := range roots {
+		size := "?"
+		if n, ok := sizes[root.StorePath]; ok {
+			size = formatSize(n)
+		}
+
+		fmt.Fprintf(os.Stdout, "%-24s %5s %10s  %s\n",
+			root.Name,
+			formatAge(time.Since(root.Created)),
+			size,
+			root.StorePath)
+	}
+
+	return nil
+}
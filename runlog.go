@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streams every child process writes to. While a run is logged they also
+// copy everything into its log file.
+var stdout io.Writer = os.Stdout
+var stderr io.Writer = os.Stderr
+
+// Receives child output that is not shown on the terminal, like build logs
+// hidden by the progress view.
+var transcript io.Writer = io.Discard
+
+const defaultLogRetention = 50
+
+const runLogTimeFormat = "20060102T150405"
+
+type RunLog struct {
+	Path    string
+	mu      sync.Mutex
+	file    *os.File
+	start   time.Time
+	restore func()
+}
+
+// teeOutput copies all child output, including the transcript, into w until
+// the returned function is called.
+func teeOutput(w io.Writer) func() {
+	prevStdout, prevStderr, prevTranscript := stdout, stderr, transcript
+
+	stdout = io.MultiWriter(stdout, w)
+	stderr = io.MultiWriter(stderr, w)
+	transcript = io.MultiWriter(transcript, w)
+
+	return func() {
+		stdout, stderr, transcript = prevStdout, prevStderr, prevTranscript
+	}
+}
+
+func (l *RunLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Write(p)
+}
+
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "no"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".local", "state", "no"), nil
+}
+
+func logsDir() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "logs"), nil
+}
+
+// openRunLog starts a log file for the run of command and tees stdout and
+// stderr into it. Old logs beyond the configured retention are removed.
+func openRunLog(command string, args []string) (*RunLog, error) {
+	logDir, err := logsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(logDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	retention := defaultLogRetention
+	if config.LogRetention > 0 {
+		retention = config.LogRetention
+	}
+	if err = rotateRunLogs(retention - 1); err != nil {
+		logger.Warn("could not remove old logs", "err", err)
+	}
+
+	start := time.Now()
+	stamp := start.Format(runLogTimeFormat)
+
+	// Runs started within the same second get a numbered log each. The
+	// number follows the time as ".02", which sorts after the "-" of the
+	// first log and keeps later runs in order.
+	path := filepath.Join(logDir, stamp+"-"+command+".log")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	for n := 2; errors.Is(err, fs.ErrExist) && n < 100; n++ {
+		path = filepath.Join(logDir, fmt.Sprintf("%s.%02d-%s.log", stamp, n, command))
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	runLog := &RunLog{Path: path, file: file, start: start}
+	fmt.Fprintf(runLog, "# no %s\n# started %s in %s\n\n",
+		strings.Join(append([]string{command}, args...), " "), start.Format(time.RFC3339), dir)
+
+	runLog.restore = teeOutput(runLog)
+
+	return runLog, nil
+}
+
+func (l *RunLog) Close(err error) {
+	l.restore()
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "error: " + err.Error()
+	}
+	fmt.Fprintf(l, "\n# finished after %s, %s\n", time.Since(l.start).Round(time.Second), outcome)
+
+	l.file.Close()
+}
+
+// runLogs returns the paths of all run logs, most recent first.
+func runLogs() ([]string, error) {
+	dir, err := logsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(paths)
+	slices.Reverse(paths)
+
+	return paths, nil
+}
+
+func rotateRunLogs(keep int) error {
+	paths, err := runLogs()
+	if err != nil {
+		return err
+	}
+
+	if keep < 0 {
+		keep = 0
+	}
+
+	for _, path := range paths[min(keep, len(paths)):] {
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func logsCmd(_ context.Context, args []string) error {
+	var pathOnly bool
+
+	flagSet := flag.NewFlagSet("logs", flag.ExitOnError)
+	flagSet.BoolVar(&pathOnly, "path", false, "print the log path")
+	flagSet.BoolVar(&pathOnly, "p", false, "print the log path")
+	flagSet.Usage = func() {
+		logger.Print(`Show logs of previous runs.
+
+Usage:
+
+    no logs [flags] [last|N]
+
+Without an argument, list all kept logs, most recent first. With 'last' or
+the number N from that list, print the log of that run.
+
+Flags:
+
+    -p, --path  BOOL
+        Print the path of the log instead of its content.
+
+    -h, --help
+        Print this help.
+
+Examples:
+
+    Show the output of the last run
+        no logs last
+
+    Open the log of the run before that in an editor
+        $EDITOR $(no logs -p 2)`)
+	}
+	flagSet.Parse(args)
+
+	paths, err := runLogs()
+	if err != nil {
+		return err
+	}
+
+	if flagSet.NArg() == 0 {
+		if pathOnly {
+			logDir, err := logsDir()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stdout, logDir)
+			return nil
+		}
+
+		type logEntry struct {
+			Index int       `json:"index"`
+			Path  string    `json:"path"`
+			Time  time.Time `json:"time"`
+			Size  int64     `json:"size"`
+		}
+		entries := []logEntry{}
+
+		for i, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if outputFormat == "json" {
+				entries = append(entries, logEntry{i + 1, path, info.ModTime(), info.Size()})
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "%4d  %s  %8d  %s\n",
+				i+1, info.ModTime().Format(time.DateTime), info.Size(), filepath.Base(path))
+		}
+
+		if outputFormat == "json" {
+			return json.NewEncoder(os.Stdout).Encode(entries)
+		}
+		return nil
+	}
+
+	idx := 1
+	if arg := flagSet.Arg(0); arg != "last" {
+		idx, err = strconv.Atoi(arg)
+		if err != nil || idx < 1 {
+			return fmt.Errorf("log must be 'last' or a number, got %q", arg)
+		}
+	}
+	if idx > len(paths) {
+		return fmt.Errorf("only %d logs kept", len(paths))
+	}
+
+	if outputFormat == "json" {
+		return json.NewEncoder(os.Stdout).Encode(map[string]string{"path": paths[idx-1]})
+	}
+
+	if pathOnly {
+		fmt.Fprintln(os.Stdout, paths[idx-1])
+		return nil
+	}
+
+	file, err := os.Open(paths[idx-1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(os.Stdout, file)
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// stageSystem builds the configuration hostName of the flake and keeps the
+// result as a GC root in the staged slot, to be activated later by no
+// activate without evaluating the flake again. rev is the revision given to
+// --rev, if any. Of opts, only the build host, label and flake apply.
+func stageSystem(ctx context.Context, hostName, slot, rev string, opts RebuildOptions) error {
+	var path string
+
+	buildHost := opts.BuildHost
+	if opts.FlakeRef == "" {
+		opts.FlakeRef = "."
+	}
+
+	report.Target = hostName
+	report.BuildHost = buildHost
+	report.Operation = "stage"
+
+	stagedDir, err := rootsDir("staged")
+	if err != nil {
+		return err
+	}
+
+	var label string
+	if opts.Label {
+		label = generationLabel()
+	}
+
+	err = runPhase(ctx, phaseBuild, func(ctx context.Context) (err error) {
+		path, err = nixBuild(ctx, systemInstallable(opts.FlakeRef, hostName), buildHost, "", label)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if buildHost != "" {
+		logger.Info("Copying " + path + " from " + buildHost + "...")
+
+		err = runPhase(ctx, phaseCopy, func(ctx context.Context) error {
+			return copyClosure(ctx, localTarget(), path, buildHost)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = addRoot(ctx, stagedDir, GCRoot{
+		Name:        slot,
+		StorePath:   path,
+		Created:     time.Now(),
+		Config:      hostName,
+		Flake:       dir,
+		FlakeCommit: report.FlakeCommit,
+		FlakeBranch: report.FlakeBranch,
+		FlakeDirty:  report.FlakeDirty,
+		Rev:         rev,
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Staged " + path + " as " + slot + ", activate it with `no activate " + slot + "`")
+	return nil
+}
+
+func activateCmd(ctx context.Context, args []string) error {
+	var boot, switchOp, test, force, check, rollback, rebootIfNeeded bool
+
+	hostName, err := os.Hostname()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	flagSet := flag.NewFlagSet("activate", flag.ExitOnError)
+	flagSet.BoolVar(&boot, "boot", false, "make the staged system the boot default")
+	flagSet.BoolVar(&switchOp, "switch", false, "switch to the staged system")
+	flagSet.BoolVar(&test, "test", false, "activate the staged system without adding it to the boot menu")
+	flagSet.BoolVar(&force, "force", false, "activate even if staged from another commit")
+	flagSet.BoolVar(&force, "f", false, "activate even if staged from another commit")
+	flagSet.BoolVar(&check, "check", false, "run health checks after activation")
+	flagSet.BoolVar(&rollback, "rollback", false, "roll back when health checks fail")
+	flagSet.BoolVar(&rebootIfNeeded, "reboot-if-needed", false, "reboot when the kernel or systemd changed")
+	flagSet.Usage = func() {
+		logger.Print(`Activate a system staged by no rebuild --stage.
+
+Usage:
+
+    no activate [flags] [slot]
+
+The slot defaults to the hostname, like the one no rebuild --stage uses. The
+staged system is activated without evaluating the flake again. It must have
+been built from the commit the flake is at now, or for a system staged with
+--rev, the commit that revision is at now, unless --force is given.
+
+Flags:
+
+    --boot  BOOL
+        Make the staged system the boot default.
+
+    --check  BOOL
+        Run the health checks of the config after switch and test.
+        (default 'true' when health checks are configured)
+
+    -f, --force  BOOL
+        Activate even if the system was staged from another commit.
+
+    --reboot-if-needed  BOOL
+        Reboot when the staged system changes its kernel, initrd, kernel
+        modules or systemd.
+
+    --rollback  BOOL
+        Roll back to the previous generation when a health check fails.
+
+    --switch  BOOL
+        Switch to the staged system. (default)
+
+    --test  BOOL
+        Activate the staged system, but do not add it to the boot menu.
+
+    -h, --help
+        Print this help.
+
+Examples:
+
+    Stage the configuration during the day and make it the boot default later
+        no rebuild --stage
+        no activate --boot`)
+	}
+	flagSet.Parse(args)
+
+	operation := "switch"
+	switch {
+	case boot && !switchOp && !test:
+		operation = "boot"
+	case test && !switchOp && !boot:
+		operation = "test"
+	case boot || test:
+		return fmt.Errorf("only one of --boot, --switch and --test can be given")
+	}
+
+	slot := hostName
+	if flagSet.NArg() > 0 {
+		slot = flagSet.Arg(0)
+	}
+
+	stagedDir, err := rootsDir("staged")
+	if err != nil {
+		return err
+	}
+
+	staged, err := readRoot(stagedDir, slot)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("nothing staged as %s, stage it with `no rebuild --stage`", slot)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A system staged from a revision is held against what that revision
+	// is now, e.g. a branch that may have moved, rather than the checkout.
+	current, what := report.FlakeCommit, "the flake"
+	if staged.Rev != "" {
+		what = staged.Rev
+		current, err = git(ctx, "rev-parse", "--verify", "--quiet", staged.Rev+"^{commit}")
+		if err != nil && !force {
+			return fmt.Errorf("%s was staged from %s, which is no longer a commit, branch or tag; use --force to activate it anyway",
+				slot, staged.Rev)
+		}
+	}
+
+	if staged.FlakeCommit != current && staged.FlakeCommit != "" && current != "" {
+		if !force {
+			return fmt.Errorf("%s was staged from commit %.12s, but %s is at %.12s; use --force to activate it anyway",
+				slot, staged.FlakeCommit, what, current)
+		}
+		logger.Warn("activating a system staged from another commit", "staged", staged.FlakeCommit, "now", current)
+	}
+	if staged.FlakeDirty {
+		logger.Warn("the staged system was built from uncommitted changes", "slot", slot)
+	}
+
+	if !flagPassed(flagSet, "check") {
+		check = len(config.HealthChecks) > 0 || len(config.Hosts[staged.Config].HealthChecks) > 0
+	}
+
+	// The run is about the staged system, not the flake as it is now.
+	report.Target = staged.Config
+	report.Operation = operation
+	report.FlakeCommit = staged.FlakeCommit
+	report.FlakeBranch = staged.FlakeBranch
+	report.FlakeDirty = staged.FlakeDirty
+	report.StorePaths = []string{staged.StorePath}
+
+	release, err := acquireLocks(ctx, LockRequest{Name: lockSystem})
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	stopKeepalive, err := escalator.Keepalive(ctx)
+	defer stopKeepalive()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Activating " + slot + " staged " + staged.Created.Format(time.DateTime) + "...")
+
+	return switchSystem(ctx, staged.Config, staged.StorePath, operation, RebuildOptions{
+		Target:         localTarget(),
+		Check:          check,
+		Rollback:       rollback,
+		RebootIfNeeded: rebootIfNeeded,
+	})
+}
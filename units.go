@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Journal lines shown for each unit that failed during activation.
+const failedUnitJournalLines = 10
+
+// UnitChanges are the systemd units switch-to-configuration touched, or
+// would touch for dry-activate.
+type UnitChanges struct {
+	Stopped   []string     `json:"stopped,omitempty"`
+	Started   []string     `json:"started,omitempty"`
+	Restarted []string     `json:"restarted,omitempty"`
+	Reloaded  []string     `json:"reloaded,omitempty"`
+	Failed    []FailedUnit `json:"failed,omitempty"`
+}
+
+type FailedUnit struct {
+	Unit    string   `json:"unit"`
+	Journal []string `json:"journal,omitempty"`
+}
+
+// FailedUnitsError is returned when switch-to-configuration failed because
+// units failed to start.
+type FailedUnitsError struct {
+	Units []string
+	Err   error
+}
+
+func (e *FailedUnitsError) Error() string {
+	return fmt.Sprintf("switch-to-configuration: units failed: %s: %s", strings.Join(e.Units, ", "), e.Err)
+}
+
+func (e *FailedUnitsError) Unwrap() error {
+	return e.Err
+}
+
+// Lines switch-to-configuration prints about units, e.g.
+// "restarting the following units: nginx.service, sshd.service".
+var (
+	unitChangeLine = regexp.MustCompile(`^(?:would )?(stop|start|restart|reload)(?:ping|ing)? the following units: (.+)$`)
+	unitNewLine    = regexp.MustCompile(`^the following new units were started: (.+)$`)
+	unitFailedLine = regexp.MustCompile(`^warning: the following units failed: (.+)$`)
+)
+
+// parseUnitChanges reads the output of switch-to-configuration.
+func parseUnitChanges(output string) UnitChanges {
+	var changes UnitChanges
+
+	add := func(list *[]string, units string) {
+		for _, unit := range strings.Split(units, ", ") {
+			if unit = strings.TrimSpace(unit); unit != "" && !slices.Contains(*list, unit) {
+				*list = append(*list, unit)
+			}
+		}
+	}
+
+	var failed []string
+
+	for _, line := range strings.Split(ansiEscape.ReplaceAllString(output, ""), "\n") {
+		line = strings.TrimSpace(line)
+
+		if match := unitChangeLine.FindStringSubmatch(line); match != nil {
+			switch match[1] {
+			case "stop":
+				add(&changes.Stopped, match[2])
+			case "start":
+				add(&changes.Started, match[2])
+			case "restart":
+				add(&changes.Restarted, match[2])
+			case "reload":
+				add(&changes.Reloaded, match[2])
+			}
+		} else if match := unitNewLine.FindStringSubmatch(line); match != nil {
+			add(&changes.Started, match[1])
+		} else if match := unitFailedLine.FindStringSubmatch(line); match != nil {
+			add(&failed, match[1])
+		}
+	}
+
+	for _, unit := range failed {
+		changes.Failed = append(changes.Failed, FailedUnit{Unit: unit})
+	}
+
+	return changes
+}
+
+func (c UnitChanges) Empty() bool {
+	return len(c.Stopped) == 0 && len(c.Started) == 0 && len(c.Restarted) == 0 &&
+		len(c.Reloaded) == 0 && len(c.Failed) == 0
+}
+
+// fetchJournals adds the last journal lines of every failed unit.
+func (c *UnitChanges) fetchJournals(ctx context.Context, target Target) {
+	for i, failed := range c.Failed {
+		var out bytes.Buffer
+
+		cmd := target.EscalatedCommand(ctx,
+			"journalctl",
+			"--unit", failed.Unit,
+			"--boot",
+			"--lines", fmt.Sprint(failedUnitJournalLines),
+			"--output", "cat",
+			"--no-pager")
+
+		cmd.Stdout = &out
+		_, cmd.Stderr = target.outputs()
+
+		if err := cmd.Run(); err != nil {
+			logger.Warn("could not read journal", "unit", failed.Unit, "err", err)
+			continue
+		}
+
+		if journal := strings.TrimRight(out.String(), "\n"); journal != "" {
+			c.Failed[i].Journal = strings.Split(journal, "\n")
+		}
+	}
+}
+
+// Print shows a summary of the changes, then the failed units with their
+// journal.
+func (c UnitChanges) Print(w io.Writer) {
+	if c.Empty() {
+		return
+	}
+
+	fmt.Fprintln(w, "")
+	for _, change := range []struct {
+		name  string
+		units []string
+	}{
+		{"stopped", c.Stopped},
+		{"started", c.Started},
+		{"restarted", c.Restarted},
+		{"reloaded", c.Reloaded},
+	} {
+		if len(change.units) > 0 {
+			fmt.Fprintf(w, "%-10s %s\n", change.name, strings.Join(change.units, ", "))
+		}
+	}
+
+	for _, failed := range c.Failed {
+		fmt.Fprintln(w, failureStyle.Render("✗")+" "+failed.Unit+" failed")
+		for _, line := range failed.Journal {
+			fmt.Fprintln(w, faintStyle.Render("    "+line))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUnitChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   UnitChanges
+	}{
+		{
+			name: "switch",
+			output: `stopping the following units: audit.service, kmod-static-nodes.service
+activating the configuration...
+setting up /etc...
+reloading user units for alice...
+restarting sysinit-reactivation.target
+reloading the following units: dbus.service
+restarting the following units: nginx.service, sshd.service
+starting the following units: network-setup.service
+the following new units were started: libvirtd.service, sysinit-reactivation.target
+Done. The new configuration is /nix/store/8v8vlsq2xjd0qlb2kn4kxy5j3g6m4rxp-nixos-system-laptop-24.11.20241201.1234567`,
+			want: UnitChanges{
+				Stopped:   []string{"audit.service", "kmod-static-nodes.service"},
+				Started:   []string{"network-setup.service", "libvirtd.service", "sysinit-reactivation.target"},
+				Restarted: []string{"nginx.service", "sshd.service"},
+				Reloaded:  []string{"dbus.service"},
+			},
+		},
+		{
+			name: "failed units",
+			output: `activating the configuration...
+setting up /etc...
+restarting the following units: nginx.service, postgresql.service
+Job for nginx.service failed because the control process exited with error code.
+See "systemctl status nginx.service" and "journalctl -xeu nginx.service" for details.
+warning: the following units failed: nginx.service, postgresql.service
+
+× nginx.service - Nginx Web Server
+     Loaded: loaded (/etc/systemd/system/nginx.service; enabled; preset: enabled)
+     Active: failed (Result: exit-code) since Sun 2024-12-01 10:00:00 UTC; 20ms ago
+warning: error(s) occurred while switching to the new configuration`,
+			want: UnitChanges{
+				Restarted: []string{"nginx.service", "postgresql.service"},
+				Failed: []FailedUnit{
+					{Unit: "nginx.service"},
+					{Unit: "postgresql.service"},
+				},
+			},
+		},
+		{
+			name: "dry-activate",
+			output: `would stop the following units: audit.service
+would activate the configuration
+would restart systemd
+would restart the following units: nginx.service
+would reload the following units: dbus.service
+would start the following units: prometheus-node-exporter.service`,
+			want: UnitChanges{
+				Stopped:   []string{"audit.service"},
+				Started:   []string{"prometheus-node-exporter.service"},
+				Restarted: []string{"nginx.service"},
+				Reloaded:  []string{"dbus.service"},
+			},
+		},
+		{
+			name: "units listed twice",
+			output: `starting the following units: network-setup.service
+the following new units were started: network-setup.service, tailscaled.service`,
+			want: UnitChanges{
+				Started: []string{"network-setup.service", "tailscaled.service"},
+			},
+		},
+		{
+			name:   "prefixed and colored",
+			output: "   \x1b[1mrestarting the following units: sshd.service\x1b[0m\r\n",
+			want: UnitChanges{
+				Restarted: []string{"sshd.service"},
+			},
+		},
+		{
+			name: "nothing changed",
+			output: `activating the configuration...
+setting up /etc...
+reloading user units for alice...
+setting up tmpfiles`,
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseUnitChanges(test.output)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseUnitChanges() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}